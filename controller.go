@@ -2,16 +2,24 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"flag"
+	"io"
+	"os"
+	"strings"
 	"time"
 	"pinpad-controller/frontend"
 	"pinpad-controller/pinpad"
 	"pinpad-controller/pinstore"
 	"pinpad-controller/hometec"
 	"pinpad-controller/ctrlsocket"
+	"pinpad-controller/events"
 	"pinpad-controller/tuerstatus"
+	"pinpad-controller/uart"
 	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 )
 
@@ -25,6 +33,121 @@ var pin_path *string = flag.String(
 	"/perm/pins.json",
 	"Path to store the PINs permanently")
 
+var pin_cache_key = flag.String(
+	"pin_cache_key",
+	"",
+	"Root-only file with the base64 encoded AES-256 key to encrypt -pin_path with (empty: stored in plain text)")
+
+var pin_emergency = flag.String(
+	"pin_emergency",
+	"",
+	"Local file with PINs which take precedence over all synced PINs and are never overwritten")
+
+var pin_url_secondary = flag.String(
+	"pin_url_secondary",
+	"",
+	"Second URL to load PINs from, with less precedence than -pin_url (empty disables)")
+
+var pin_path_secondary = flag.String(
+	"pin_path_secondary",
+	"/perm/pins-secondary.json",
+	"Path to store the PINs of -pin_url_secondary permanently")
+
+var pin_cert = flag.String(
+	"pin_cert",
+	"",
+	"PEM file with the client certificate for the -pin_url host (mutual TLS)")
+
+var pin_key = flag.String(
+	"pin_key",
+	"",
+	"PEM file with the key of -pin_cert")
+
+var pin_ca = flag.String(
+	"pin_ca",
+	"",
+	"PEM file with the CA certificates the BenutzerDB certificate has to be signed by (empty: system CAs)")
+
+var pin_fingerprint = flag.String(
+	"pin_fingerprint",
+	"",
+	"SHA-256 fingerprint (hex) of the BenutzerDB certificate, which is the only one accepted")
+
+var pin_credentials = flag.String(
+	"pin_credentials",
+	"",
+	"File with user:password for the BenutzerDB (instead of putting them into -pin_url), only sent to the host of -pin_url over https")
+
+var pin_timeout = flag.Duration(
+	"pin_timeout",
+	30*time.Second,
+	"Timeout of requests to the BenutzerDB")
+
+var pin_delta = flag.Bool(
+	"pin_delta",
+	false,
+	"Ask the BenutzerDB for only the changes since the last sync (RFC 3229 delta)")
+
+var sync_interval = flag.Duration(
+	"sync_interval",
+	1*time.Minute,
+	"How often to sync the PINs")
+
+var sync_max_interval = flag.Duration(
+	"sync_max_interval",
+	30*time.Minute,
+	"Upper limit of the exponential backoff after failed syncs")
+
+var sync_stale_after = flag.Duration(
+	"sync_stale_after",
+	10*time.Minute,
+	"Show a warning on the display after syncs failed for this long")
+
+var sync_failing_after = flag.Duration(
+	"sync_failing_after",
+	1*time.Hour,
+	"Beep and blink after syncs failed for this long")
+
+var usage_url = flag.String(
+	"usage_url",
+	"",
+	"URL to POST the uses of limited-use PINs to (empty disables reporting)")
+
+var totp_drift = flag.Int(
+	"totp_drift",
+	1,
+	"How many 30s time steps a TOTP code may be off")
+
+var close_pin = flag.String(
+	"close_pin",
+	"666",
+	"PIN which anyone can use to lock the door (empty: locking requires *PIN# of someone allowed to)")
+
+var open_hours = flag.String(
+	"open_hours",
+	"",
+	"Schedule in which members may open the door, e.g. \"mon,tue 18:00-23:00;sat 10:00-22:00\" (empty: always)")
+
+var pin_pubkey = flag.String(
+	"pin_pubkey",
+	"",
+	"File with the base64 encoded Ed25519 public key the PIN list has to be signed with")
+
+var pin_max_removed = flag.Int(
+	"pin_max_removed",
+	pinstore.DefaultGuards.MaxRemovedPercent,
+	"Hold PIN updates which remove more than this percentage of the entries (by handle) until confirmed (0 disables)")
+
+var pin_min_count = flag.Int(
+	"pin_min_count",
+	pinstore.DefaultGuards.MinCount,
+	"Hold PIN updates with less PINs than this until confirmed")
+
+var audit_log = flag.String(
+	"audit_log",
+	"/perm/audit.log",
+	"File to append all events (e.g. duress alarms) to (empty disables)")
+
 var broker = flag.String(
 	"broker",
 	"tcp://infra.rzl:1883",
@@ -35,6 +158,79 @@ var topic = flag.String(
 	"/service/status",
 	"The topic to which the door state will be published")
 
+var event_topic = flag.String(
+	"event_topic",
+	"/service/pinpad/events",
+	"The topic to which events (e.g. quarantined PIN updates) will be published")
+
+var pin_changes_topic = flag.String(
+	"pin_changes_topic",
+	"/service/pinpad/pins",
+	"The topic to which the number of added, removed and changed PINs will be published")
+
+// A frontend as specified on the command line: [role:]path[@serial]
+type frontendSpec struct {
+	role   string
+	path   string
+	serial string
+}
+
+type frontendSpecs []frontendSpec
+
+func (f *frontendSpecs) String() string {
+	var specs []string
+	for _, spec := range *f {
+		s := spec.role + ":" + spec.path
+		if spec.serial != "" {
+			s += "@" + spec.serial
+		}
+		specs = append(specs, s)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *frontendSpecs) Set(value string) error {
+	spec := frontendSpec{role: "outside", path: value}
+	if idx := strings.Index(spec.path, "@"); idx > -1 {
+		spec.serial = spec.path[idx+1:]
+		spec.path = spec.path[:idx]
+	}
+	if idx := strings.Index(spec.path, ":"); idx > -1 {
+		spec.role = spec.path[:idx]
+		spec.path = spec.path[idx+1:]
+	}
+	if _, ok := pinpad.Policies[spec.role]; !ok {
+		return fmt.Errorf("unknown role %q (expected outside or inside)", spec.role)
+	}
+	if spec.path == "" {
+		return fmt.Errorf("no path given")
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+var frontends frontendSpecs
+
+func init() {
+	flag.Var(&frontends, "frontend",
+		"Serial interface of a frontend (or the pty of the emulator), "+
+			"optionally with role (outside or inside) and serial settings, "+
+			"e.g. inside:/dev/ttyUSB0@19200,8N1. Can be given multiple times. "+
+			"Default: outside:/dev/ttyAMA0")
+}
+
+var serial = flag.String(
+	"serial",
+	uart.DefaultConfig.String(),
+	"Serial settings of the frontends, e.g. 9600,8N1 or 115200,8N1,rtscts,rts")
+
+var capture = flag.String(
+	"capture",
+	"",
+	"File to record the serial traffic with the frontend to (for replay, created with mode 0600). "+
+		"Digits entered on the keypad are recorded as x. "+
+		"Every frontend except the first one is recorded to <file>.<role>")
+
 var lastPublishedStatus tuerstatus.Tuerstatus
 var newStatus tuerstatus.Tuerstatus
 
@@ -51,17 +247,32 @@ var newStatus tuerstatus.Tuerstatus
 //    dann verbasteln.
 //    Kann man inotify auf /sys machen mit den GPIOs?
 
-func updatePins(pins *pinstore.Pinstore, fe *frontend.Frontend) {
-	for {
-		time.Sleep(1 * time.Minute)
-		pins.Update(*pin_url, fe)
+// Syncs all PIN sources and reports the usage of limited-use PINs. Only
+// failed syncs count as failure, a failed sync of the secondary source takes
+// precedence over a held update of the primary one.
+func updatePins(pins *pinstore.Pinstore) error {
+	err := pins.Update(*pin_url)
+	if *pin_url_secondary != "" {
+		secondaryErr := pins.UpdateSecondary(*pin_url_secondary)
+		var held *pinstore.QuarantineError
+		if err == nil || (errors.As(err, &held) && secondaryErr != nil) {
+			err = secondaryErr
+		}
 	}
+	if *usage_url != "" {
+		if err := pins.ReportUsage(*usage_url); err != nil {
+			fmt.Printf("Cannot report PIN usage: %v\n", err)
+		}
+	}
+	return err
 }
 
-func publishMqtt() {
+// Connects to the broker as clientId, publishes payload to topic and
+// disconnects. Concurrent connections need different client ids.
+func mqttPublish(clientId string, topic string, payload []byte, retained bool) error {
 	opts := mqtt.NewClientOptions()
 	opts.SetBroker(*broker)
-	opts.SetClientId("pinpad-main")
+	opts.SetClientId(clientId)
 	opts.SetCleanSession(true)
 	opts.SetTraceLevel(mqtt.Off)
 
@@ -71,13 +282,20 @@ func publishMqtt() {
 	})
 
 	client := mqtt.NewClient(opts)
-	_, err := client.Start()
-
-	if err != nil {
-		fmt.Printf("could not connect to mqtt broker: %s\n", err)
-		return
+	if _, err := client.Start(); err != nil {
+		return err
 	}
 
+	mqttMsg := mqtt.NewMessage(payload)
+	mqttMsg.SetQoS(mqtt.QOS_ONE)
+	mqttMsg.SetRetainedFlag(retained)
+	r := client.PublishMessage(topic, mqttMsg)
+	<-r
+	client.ForceDisconnect()
+	return nil
+}
+
+func publishMqtt() {
 	var msg string
 	if (newStatus.Open) {
 		msg = "\"open\""
@@ -85,21 +303,102 @@ func publishMqtt() {
 		msg = "\"closed\""
 	}
 
-	mqttMsg := mqtt.NewMessage([]byte(msg))
-	mqttMsg.SetQoS(mqtt.QOS_ONE)
-	mqttMsg.SetRetainedFlag(true)
-	r := client.PublishMessage(*topic, mqttMsg)
-	<-r
+	if err := mqttPublish("pinpad-main", *topic, []byte(msg), true); err != nil {
+		fmt.Printf("could not connect to mqtt broker: %s\n", err)
+		return
+	}
 	lastPublishedStatus = newStatus
-	client.ForceDisconnect()
+}
+
+// Forwards all events to MQTT. Events which cannot be published are only
+// logged (by the events package).
+func publishEvents(ch chan events.Event) {
+	for event := range ch {
+		payload, _ := json.Marshal(event)
+		if err := mqttPublish("pinpad-events", *event_topic, payload, false); err != nil {
+			fmt.Printf("could not publish event: %s\n", err)
+		}
+	}
+}
+
+// Publishes how many entries changed with a PIN update.
+func publishPinChanges(source string, generation uint64, d *pinstore.Diff) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"source":     source,
+		"generation": generation,
+		"added":      len(d.Added),
+		"removed":    len(d.Removed),
+		"changed":    len(d.Changed),
+	})
+	if err := mqttPublish("pinpad-pins", *pin_changes_topic, payload, true); err != nil {
+		fmt.Printf("could not publish PIN changes: %s\n", err)
+	}
+}
+
+// Opens the frontend described by spec. idx is the position of spec on the
+// command line.
+func openFrontend(spec frontendSpec, idx int) *frontend.Frontend {
+	serialSpec := *serial
+	if spec.serial != "" {
+		serialSpec = spec.serial
+	}
+	serialConfig, err := uart.ParseConfig(serialSpec)
+	if err != nil {
+		log.Fatalf("Invalid serial settings for %s: %v", spec.path, err)
+	}
+	var captureFile io.Writer
+	if *capture != "" {
+		path := *capture
+		if idx > 0 {
+			path += "." + spec.role
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Could not open capture file: %v", err)
+		}
+		captureFile = f
+	}
+	fe, _ := frontend.OpenFrontendConfig(spec.path, serialConfig, captureFile)
+	if e := fe.Beep(frontend.BEEP_SHORT); e != nil {
+		fmt.Printf("cannot beep on %s\n", spec.path)
+	}
+	return fe
 }
 
 func main() {
 	flag.Parse()
 
-	fe, _ := frontend.OpenFrontend("/dev/ttyAMA0")
-	if e := fe.Beep(frontend.BEEP_SHORT); e != nil {
-		fmt.Println("cannot beep")
+	go publishEvents(events.Subscribe())
+	if *audit_log != "" {
+		if err := events.AuditLog(*audit_log); err != nil {
+			fmt.Printf("Cannot open audit log: %v\n", err)
+		}
+	}
+
+	if len(frontends) == 0 {
+		frontends.Set("outside:/dev/ttyAMA0")
+	}
+	openHours, err := pinstore.ParseWindows(*open_hours)
+	if err != nil {
+		log.Fatalf("Invalid -open_hours: %v", err)
+	}
+	var keypads []pinpad.Keypad
+	for idx, spec := range frontends {
+		policy := pinpad.Policies[spec.role]
+		policy.ClosePin = *close_pin
+		policy.OpenHours = openHours
+		keypads = append(keypads, pinpad.Keypad{
+			Frontend: openFrontend(spec, idx),
+			Policy:   policy,
+		})
+	}
+	// The control socket uses the outside keypad (or the first one, if there
+	// is none).
+	fe := keypads[0].Frontend
+	for idx := len(keypads) - 1; idx >= 0; idx-- {
+		if keypads[idx].Policy.Role == "outside" {
+			fe = keypads[idx].Frontend
+		}
 	}
 
 	hometec, _ := hometec.OpenHometec()
@@ -108,10 +407,8 @@ func main() {
 	go func() {
 		for {
 			newStatus = <-tuerstatusChannel
-			if newStatus.Open {
-				fe.LcdSet(" \nOpen")
-			} else {
-				fe.LcdSet(" \nClosed")
+			for _, keypad := range keypads {
+				keypad.Frontend.Screen.SetDoor(newStatus.Open)
 			}
 		}
 	}()
@@ -130,16 +427,72 @@ func main() {
 		}
 	}()
 
-	pins, err := pinstore.Load(*pin_path)
+	var cacheKey []byte
+	if *pin_cache_key != "" {
+		if cacheKey, err = pinstore.LoadCacheKey(*pin_cache_key); err != nil {
+			log.Fatalf("Could not load cache key: %v", err)
+		}
+	}
+	var publicKey ed25519.PublicKey
+	if *pin_pubkey != "" {
+		if publicKey, err = pinstore.LoadPublicKey(*pin_pubkey); err != nil {
+			log.Fatalf("Could not load public key: %v", err)
+		}
+	} else {
+		fmt.Printf("No -pin_pubkey given, PIN lists are not verified\n")
+	}
+	pins, err := pinstore.LoadWithOptions(*pin_path, pinstore.Options{
+		Key:       cacheKey,
+		PublicKey: publicKey,
+		// Counters of removed PINs are only kept to be reported.
+		KeepUnreported: *usage_url != "",
+	})
 	if err != nil {
 		log.Fatalf("Could not load pins: %v", err)
 	}
-	if err := pins.Update(*pin_url, fe); err != nil {
-		fmt.Printf("Cannot update pins: %v\n", err)
+	pins.Client, err = pinstore.NewClient(pinstore.ClientConfig{
+		CertFile:        *pin_cert,
+		KeyFile:         *pin_key,
+		CAFile:          *pin_ca,
+		Fingerprint:     *pin_fingerprint,
+		CredentialsFile: *pin_credentials,
+		ServerURL:       *pin_url,
+		Timeout:         *pin_timeout,
+	})
+	if err != nil {
+		log.Fatalf("Invalid PIN sync settings: %v", err)
 	}
+	pins.Delta = *pin_delta
+	pins.OnChange = func(source string, generation uint64, d *pinstore.Diff) {
+		// Called during the sync, which must not wait for the broker.
+		go publishPinChanges(source, generation, d)
+	}
+	pins.TOTPDrift = *totp_drift
+	pins.Guards = pinstore.DefaultGuards
+	pins.Guards.MaxRemovedPercent = *pin_max_removed
+	pins.Guards.MinCount = *pin_min_count
+	if *pin_emergency != "" {
+		if err := pins.LoadEmergency(*pin_emergency); err != nil {
+			log.Fatalf("Could not load emergency pins: %v", err)
+		}
+	}
+	if *pin_url_secondary != "" {
+		if err := pins.AddSecondary(*pin_path_secondary); err != nil {
+			log.Fatalf("Could not load secondary pins: %v", err)
+		}
+	}
+	scheduler := pinstore.NewScheduler(func() error { return updatePins(pins) })
+	scheduler.Interval = *sync_interval
+	scheduler.MaxInterval = *sync_max_interval
+	scheduler.StaleAfter = *sync_stale_after
+	scheduler.FailingAfter = *sync_failing_after
+	for _, keypad := range keypads {
+		scheduler.Frontends = append(scheduler.Frontends, keypad.Frontend)
+	}
+	// Clears the held state right away.
+	pins.OnConfirm = scheduler.SyncNow
+	go scheduler.Run()
 
-	go updatePins(pins, fe)
-
-	ctrlsocket.Listen(fe, hometec.Control)
-	pinpad.ValidatePin(pins, fe, hometec.Control)
+	ctrlsocket.Listen(fe, hometec.Control, pins, scheduler)
+	pinpad.ValidatePins(pins, keypads, hometec.Control)
 }
@@ -5,10 +5,13 @@ import (
 	"os"
     "net"
 	"fmt"
+	"strings"
+	"pinpad-controller/events"
 	"pinpad-controller/frontend"
+	"pinpad-controller/pinstore"
 )
 
-func Listen(fe *frontend.Frontend, ht chan string) {
+func Listen(fe *frontend.Frontend, ht chan string, ps *pinstore.Pinstore, sched *pinstore.Scheduler) {
     _ = os.Remove("/tmp/pinpad-ctrl.sock")
     l, err := net.Listen("unix", "/tmp/pinpad-ctrl.sock")
     if err != nil {
@@ -23,12 +26,12 @@ func Listen(fe *frontend.Frontend, ht chan string) {
                 fmt.Printf("pinpad-ctrl: accept error: %s\n", err)
                 return
             }
-            go cmdHandler(fd, fe, ht)
+            go cmdHandler(fd, fe, ht, ps, sched)
         }
     }()
 }
 
-func cmdHandler(c net.Conn, fe *frontend.Frontend, ht chan string) {
+func cmdHandler(c net.Conn, fe *frontend.Frontend, ht chan string, ps *pinstore.Pinstore, sched *pinstore.Scheduler) {
     for {
         buf := make([]byte, 32)
         nr, err := c.Read(buf)
@@ -51,6 +54,27 @@ func cmdHandler(c net.Conn, fe *frontend.Frontend, ht chan string) {
             case "close":
                 ht <- "close"
                 resp = []byte("ok\n")
+            case "status":
+                resp = []byte(ps.Status())
+            case "sync":
+                resp = []byte(sched.Status().String() + "\n")
+            case "quarantine":
+                if reasons := ps.Quarantined(); reasons != nil {
+                    resp = []byte("held: " + strings.Join(reasons, ", ") + "\n")
+                } else {
+                    resp = []byte("none\n")
+                }
+            case "confirm-pins":
+                resp = result(ps.Confirm())
+            case "reject-pins":
+                resp = result(ps.Reject())
+            case "events":
+                // Streams all events until the client disconnects.
+                ch := events.Subscribe()
+                err := events.WriteEvents(c, ch)
+                events.Unsubscribe(ch)
+                fmt.Printf("pinpad-ctrl: event stream ended: %s\n", err)
+                return
             default:
                 resp = []byte("error: unknown cmd\n")
         }
@@ -62,3 +86,10 @@ func cmdHandler(c net.Conn, fe *frontend.Frontend, ht chan string) {
         }
     }
 }
+
+func result(err error) []byte {
+    if err != nil {
+        return []byte("error: " + err.Error() + "\n")
+    }
+    return []byte("ok\n")
+}
@@ -0,0 +1,252 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Emulates the pinpad frontend on a pseudo terminal so that the controller can
+// be developed on a laptop:
+//
+//	$ emulator
+//	frontend emulator on /dev/pts/7
+//	$ pinpad-controller -frontend=/dev/pts/7 …
+//
+// The emulator speaks the whole frontend protocol, renders the LCD and the
+// LEDs in the terminal and sends keystrokes (0-9, * and #) as keypad presses.
+// Enter is an alias for #, q quits.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pinpad-controller/frontend"
+	"pinpad-controller/uart"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var version = flag.Int(
+	"version",
+	1,
+	"Firmware version to announce, 0 emulates firmware which does not answer HELLO")
+
+var checksum = flag.Bool(
+	"checksum",
+	true,
+	"Announce CAP_CHECKSUM and send checksums")
+
+const numLEDs = 3
+
+// Characters of the HD44780 A00 ROM which differ from Latin-1, so that the
+// terminal shows what the LCD would show.
+var romCharacters = map[byte]rune{
+	0xE1: 'ä', 0xEF: 'ö', 0xF5: 'ü', 0xE2: 'ß', 0xE4: 'µ', 0xDF: '°',
+	0xA5: '·', 0xEE: 'ñ', 0xEC: '¢', 0xFD: '÷', 0xF7: 'π', 0xF4: 'Ω',
+	0xF6: 'Σ', 0x7E: '→', 0x7F: '←', 0x5C: '¥',
+}
+
+type emulator struct {
+	pty *os.File
+
+	lcd     [frontend.LCD_LINES][frontend.LCD_WIDTH]byte
+	row     int
+	col     int
+	leds    [numLEDs]time.Time
+	glyphs  int
+	beep    string
+	lastKey string
+}
+
+func (e *emulator) clearLCD() {
+	for row := range e.lcd {
+		for col := range e.lcd[row] {
+			e.lcd[row][col] = ' '
+		}
+	}
+	e.row, e.col = 0, 0
+}
+
+// putLCD writes text like the firmware does: a newline continues on the second
+// line, so does the 17th character of the first line.
+func (e *emulator) putLCD(text string) {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			e.row, e.col = 1, 0
+			continue
+		}
+		if e.col == frontend.LCD_WIDTH && e.row == 0 {
+			e.row, e.col = 1, 0
+		}
+		if e.col < frontend.LCD_WIDTH {
+			e.lcd[e.row][e.col] = text[i]
+			e.col++
+		}
+	}
+}
+
+func (e *emulator) send(payload string) {
+	packet := "^" + payload + "$"
+	if *checksum && *version > 0 {
+		packet = fmt.Sprintf("^%s*%02X$", payload, frontend.Checksum([]byte(payload)))
+	}
+	if _, err := e.pty.Write([]byte(packet)); err != nil {
+		log.Printf("Could not write to the pty: %s", err)
+	}
+}
+
+// handle executes one packet (without ^ and $) from the controller.
+func (e *emulator) handle(packet string) {
+	command := packet
+	args := ""
+	if idx := strings.IndexByte(packet, ' '); idx != -1 {
+		command, args = packet[:idx], packet[idx+1:]
+	}
+	switch command {
+	case "PING":
+		if len(args) >= 2 {
+			e.send("PONG " + args[:2])
+		}
+	case "HELLO":
+		if *version > 0 {
+			capabilities := frontend.CAP_GLYPHS
+			if *checksum {
+				capabilities |= frontend.CAP_CHECKSUM
+			}
+			e.send(fmt.Sprintf("HI %02x%02x", *version, uint8(capabilities)))
+		}
+	case "LCD":
+		e.clearLCD()
+		e.putLCD(strings.TrimRight(args, " "))
+	case "LCH":
+		e.putLCD(strings.TrimRight(args, " "))
+	case "LED":
+		var idx, duration int
+		if _, err := fmt.Sscanf(args, "%d %d", &idx, &duration); err == nil && idx >= 1 && idx <= numLEDs {
+			e.leds[idx-1] = time.Now().Add(time.Duration(duration) * time.Millisecond)
+		}
+	case "BEEP":
+		e.beep = "BEEP " + strings.TrimSpace(args)
+		fmt.Print("\a")
+	case "CGR":
+		var slot int
+		if _, err := fmt.Sscanf(args, "%d", &slot); err == nil {
+			e.glyphs |= 1 << uint(slot)
+		}
+	default:
+		log.Printf("Unknown command %q", packet)
+	}
+}
+
+func (e *emulator) lcdLine(row int) string {
+	var line bytes.Buffer
+	for _, b := range e.lcd[row] {
+		if r, ok := romCharacters[b]; ok {
+			line.WriteRune(r)
+		} else if b >= 0x01 && b <= 0x0F {
+			// Custom glyphs, shown in reverse video. Like on the HD44780,
+			// 0x00-0x07 and 0x08-0x0F both address CGRAM slots 0-7 (the
+			// frontend uses 0x08 for slot 0, see glyphByte).
+			line.WriteString("\033[7m" + strconv.Itoa(int(b&0x07)) + "\033[0m")
+		} else if b < ' ' || b >= 0x80 {
+			line.WriteByte('?')
+		} else {
+			line.WriteByte(b)
+		}
+	}
+	return line.String()
+}
+
+func (e *emulator) render(slavePath string) {
+	var leds bytes.Buffer
+	colors := [numLEDs]string{"33", "31", "32"}
+	for idx, until := range e.leds {
+		if time.Now().Before(until) {
+			fmt.Fprintf(&leds, " \033[%sm●\033[0m", colors[idx])
+		} else {
+			leds.WriteString(" ○")
+		}
+	}
+	border := strings.Repeat("-", frontend.LCD_WIDTH)
+	// Clear the screen, then draw.
+	fmt.Printf("\033[H\033[2J")
+	fmt.Printf("frontend emulator on %s\n\n", slavePath)
+	fmt.Printf("+%s+\n|%s|\n|%s|\n+%s+\n", border, e.lcdLine(0), e.lcdLine(1), border)
+	fmt.Printf("LEDs:%s   glyphs: %08b   %s\n\n", leds.String(), e.glyphs, e.beep)
+	fmt.Printf("last key: %s   (0-9, *, #/Enter, q quits)\n", e.lastKey)
+}
+
+func main() {
+	flag.Parse()
+
+	pty, slavePath, err := uart.OpenPTY()
+	if err != nil {
+		log.Fatalf("Could not create pty: %s", err)
+	}
+	// We keep the slave side open, otherwise reading from the master fails
+	// until the controller opened it. Raw mode prevents the line discipline
+	// from echoing our packets back.
+	slave, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", slavePath, err)
+	}
+	defer slave.Close()
+	if _, err := uart.MakeRaw(slave); err != nil {
+		log.Fatalf("Could not put %s into raw mode: %s", slavePath, err)
+	}
+
+	restore, err := uart.MakeRaw(os.Stdin)
+	if err != nil {
+		log.Fatalf("Could not put the terminal into raw mode: %s", err)
+	}
+	defer restore()
+
+	packets := make(chan string)
+	go func() {
+		reader := bufio.NewReader(pty)
+		for {
+			data, err := reader.ReadString('$')
+			if err != nil {
+				log.Fatalf("Could not read from the pty: %s", err)
+			}
+			if idx := strings.LastIndex(data, "^"); idx != -1 {
+				packets <- data[idx+1 : len(data)-1]
+			}
+		}
+	}()
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	e := &emulator{pty: pty}
+	e.clearLCD()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for {
+		select {
+		case packet := <-packets:
+			e.handle(packet)
+		case key, ok := <-keys:
+			if !ok || key == 'q' || key == 3 {
+				return
+			}
+			if key == '\r' || key == '\n' {
+				key = '#'
+			}
+			if (key >= '0' && key <= '9') || key == '*' || key == '#' {
+				e.lastKey = string(key)
+				e.send(fmt.Sprintf("PAD %c  ", key))
+			}
+		case <-ticker.C:
+		}
+		e.render(slavePath)
+	}
+}
@@ -0,0 +1,28 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the LCD rendering of the emulator.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLcdLine(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		expected string
+	}{
+		{"\x03Sync fail", "\033[7m3\033[0mSync fail"},
+		{"\x01\x07\x08\x0F", "\033[7m1\033[0m\033[7m7\033[0m\033[7m0\033[0m\033[7m7\033[0m"},
+		{"Gr\xF5n", "Grün"},
+		{"\x10\x80", "??"},
+	} {
+		var e emulator
+		e.clearLCD()
+		e.putLCD(test.text)
+		if line := strings.TrimRight(e.lcdLine(0), " "); line != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.text, test.expected, line)
+		}
+	}
+}
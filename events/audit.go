@@ -0,0 +1,38 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The audit log: a file to which every event is appended, one line per event.
+package events
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// WriteEvents writes the events of ch to w, one line per event, until ch is
+// closed.
+func WriteEvents(w io.Writer, ch chan Event) error {
+	for event := range ch {
+		if _, err := fmt.Fprintln(w, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditLog appends all events published from now on to filename.
+func AuditLog(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	ch := Subscribe()
+	go func() {
+		if err := WriteEvents(f, ch); err != nil {
+			fmt.Printf("event: could not write audit log: %s\n", err)
+			Unsubscribe(ch)
+		}
+		f.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,68 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Distribution of events which the operators should know about (for example
+// a PIN update which was held back) to subscribers like MQTT. Every event is
+// also logged.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Time time.Time
+	// e.g. "pins.quarantined"
+	Type    string
+	Message string
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%s %s: %s", e.Time.Format(time.RFC3339), e.Type, e.Message)
+}
+
+// How many events a subscriber may lag behind before events are dropped.
+const subscriberBuffer = 64
+
+var (
+	mu          sync.Mutex
+	subscribers = make(map[chan Event]bool)
+)
+
+// Subscribe returns a channel which receives all events published from now
+// on. Subscribers need to keep up: when the channel is full, events for this
+// subscriber are dropped instead of blocking the publisher.
+func Subscribe() chan Event {
+	mu.Lock()
+	defer mu.Unlock()
+	ch := make(chan Event, subscriberBuffer)
+	subscribers[ch] = true
+	return ch
+}
+
+// Unsubscribe stops sending events to ch and closes it.
+func Unsubscribe(ch chan Event) {
+	mu.Lock()
+	defer mu.Unlock()
+	if subscribers[ch] {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish logs the event and sends it to all subscribers.
+func Publish(typ string, format string, args ...interface{}) {
+	event := Event{Time: time.Now(), Type: typ, Message: fmt.Sprintf(format, args...)}
+	fmt.Printf("event: %s: %s\n", event.Type, event.Message)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+			fmt.Printf("event: subscriber too slow, dropping %s\n", event.Type)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the events package.
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	ch := Subscribe()
+	Publish("test.event", "hello %d", 42)
+
+	event := <-ch
+	if event.Type != "test.event" || event.Message != "hello 42" {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("Channel not closed after Unsubscribe")
+	}
+	// Must not panic or block.
+	Publish("test.event", "nobody listens")
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+	for i := 0; i < subscriberBuffer+10; i++ {
+		Publish("test.event", "%d", i)
+	}
+	if len(ch) != subscriberBuffer {
+		t.Errorf("Expected %d buffered events, got %d", subscriberBuffer, len(ch))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "events_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	if err := AuditLog(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	Publish("alarm.duress", "duress PIN of %s used", "secure")
+
+	for i := 0; i < 100; i++ {
+		contents, _ := ioutil.ReadFile(f.Name())
+		if strings.HasSuffix(string(contents), " alarm.duress: duress PIN of secure used\n") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Event not written to the audit log")
+}
@@ -7,12 +7,14 @@ package frontend
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"pinpad-controller/uart"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,7 +28,27 @@ const (
 type Frontend struct {
 	tty        uart.TTYish
 	Keypresses chan KeyPressEvent
-	IgnoreKeypress bool
+	// Keypresses are dropped until then (UnixNano), see IgnoreKeypresses.
+	ignoreUntil atomic.Int64
+	// The firmware version and capabilities reported in response to HELLO.
+	// Version 0 means that the firmware did not answer (firmware from before
+	// HELLO was introduced).
+	Version      int
+	Capabilities Capability
+	// Whether the custom glyphs were uploaded, see EnableGlyphs().
+	CustomGlyphs bool
+	// The screen manager for the LCD of this frontend.
+	Screen *Screen
+
+	// Receives the payload of the ^HI packet.
+	hello chan string
+	parser Parser
+	// Closed by OpenFrontendish once the frontend is set up. Keypresses
+	// before are dropped, since nobody reads them yet.
+	ready chan bool
+	// Closed by Close() to stop all Go functions of the frontend.
+	closed    chan bool
+	closeOnce sync.Once
 }
 
 type KeyPressEvent struct {
@@ -37,21 +59,67 @@ type KeyPressEvent struct {
 func OpenFrontendish(ttyish uart.TTYish) *Frontend {
 	fe := new(Frontend)
 	fe.Keypresses = make(chan KeyPressEvent)
+	fe.hello = make(chan string, 1)
+	fe.ready = make(chan bool)
+	fe.closed = make(chan bool)
 	fe.tty = ttyish
 	go fe.readAndPing()
+	fe.negotiate()
+	if fe.Has(CAP_GLYPHS) {
+		if err := fe.EnableGlyphs(); err != nil {
+			fmt.Printf("frontend: cannot upload LCD glyphs: %s\n", err)
+		}
+	}
+	fe.Screen = NewScreen(fe)
+	close(fe.ready)
 	return fe
 }
 
+// Close stops reading from and pinging the frontend and closes the TTYish (if
+// it implements io.Closer), which unblocks a pending read. Keypresses is not
+// closed, so readers block forever.
+func (fe *Frontend) Close() error {
+	var err error
+	fe.closeOnce.Do(func() {
+		close(fe.closed)
+		if closer, ok := fe.tty.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// IgnoreKeypresses drops all keypresses for d, e.g. to slow down guessing
+// after an invalid PIN. A d of 0 accepts keypresses again right away.
+func (fe *Frontend) IgnoreKeypresses(d time.Duration) {
+	fe.ignoreUntil.Store(time.Now().Add(d).UnixNano())
+}
+
+// Stats returns the counters of the inbound packet parser.
+func (fe *Frontend) Stats() ParserStats {
+	return fe.parser.Stats()
+}
+
 func OpenFrontend(path string) (frontend *Frontend, err error) {
-	ttyish, e := uart.OpenTTY(path, uart.B9600)
+	return OpenFrontendConfig(path, uart.DefaultConfig, nil)
+}
+
+// OpenFrontendConfig is like OpenFrontend, but uses the given serial settings.
+// If capture is not nil, all serial traffic is recorded to capture, see
+// uart.Recorder.
+func OpenFrontendConfig(path string, config uart.Config, capture io.Writer) (frontend *Frontend, err error) {
+	tty, e := uart.OpenTTY(path, config)
 	if e != nil {
 		return nil, e
 	}
-	return OpenFrontendish(ttyish), nil
+	if capture != nil {
+		return OpenFrontendish(uart.NewRecorder(tty, capture)), nil
+	}
+	return OpenFrontendish(tty), nil
 }
 
-// readAndPing takes care of reading bytes, filling a buffer and then sending
-// the message on the communication channel. Also, it triggers a PING request
+// readAndPing takes care of reading bytes, parsing them into packets (see
+// Parser) and then sending the message on the communication channel. Also, it triggers a PING request
 // every second.
 //
 // readAndPing is called as a Go function in OpenFrontend.
@@ -59,13 +127,8 @@ func (fe *Frontend) readAndPing() {
 	// We have one Go function running in the background and triggering a
 	// message every second. Upon receiving the message, readAndPing() will
 	// send a PING request to the frontend.
-	secondPassed := make(chan bool, 1)
-	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			secondPassed <- true
-		}
-	}()
+	secondPassed := time.NewTicker(1 * time.Second)
+	defer secondPassed.Stop()
 
 	// We have another Go function which will (blockingly) read from the TTY.
 	// Whenever there is a new byte received (which is not the 0 byte, our
@@ -76,6 +139,12 @@ func (fe *Frontend) readAndPing() {
 		for {
 			nextByte, err := reader.ReadByte()
 			if err != nil {
+				// Close() interrupts the read, that is not an error.
+				select {
+				case <-fe.closed:
+					return
+				default:
+				}
 				fmt.Printf("Error reading from the serial interface: %s\n", err)
 				fmt.Printf("Do you have console=ttyS0 in your kernel cmdline maybe?\n")
 				os.Exit(1)
@@ -87,48 +156,79 @@ func (fe *Frontend) readAndPing() {
 				continue
 			}
 
-			byteChannel <- nextByte
+			select {
+			case byteChannel <- nextByte:
+			case <-fe.closed:
+				return
+			}
 		}
 	}()
 
-	var receiveBuffer bytes.Buffer
 	// Stores the PING value we sent to the frontend. Will be checked before
 	// sending the next value so that we can detect packet loss. If this is the
 	// empty string, the frontend PONGed, otherwise it contains the value we
 	// sent but did not get acknowledged.
 	previousPing := ""
+	pings := 0
+	var reportedStats ParserStats
 	for {
 		select {
 		case nextByte := <-byteChannel:
-			// If we are at the beginning of a buffer, we only accept the
-			// leading "^" byte.
-			if receiveBuffer.Len() == 0 && nextByte != '^' {
-				continue
+			packet, err := fe.parser.Feed(nextByte)
+			if err != nil {
+				fmt.Printf("pinpad-frontend: %s\n", err)
 			}
-			receiveBuffer.WriteByte(nextByte)
-			// Check whether the buffer is complete yet. Every buffer has
-			// exactly 9 bytes.
-			if receiveBuffer.Len() != 9 {
+			if packet == "" {
 				continue
 			}
-			packet := receiveBuffer.String()
-			if strings.HasPrefix(packet, "^PONG ") {
+			if strings.HasPrefix(packet, "^PONG ") && len(packet) >= len("^PONG xx$") {
 				pong := packet[len("^PONG ") : len("^PONG ")+2]
 				if pong != previousPing {
 					fmt.Printf("pinpad-frontend sent %s, but we expected %s\n", pong, previousPing)
 				}
 				// Clear previous ping, that means it was acknowledged
 				previousPing = ""
-			} else if strings.HasPrefix(packet, "^PAD ") {
+			} else if strings.HasPrefix(packet, "^HI ") {
+				payload := packet[len("^HI ") : len(packet)-1]
+				// From now on, the firmware sends checksums (if it can), so
+				// we can detect corrupted packets.
+				if _, capabilities, err := parseHello(payload); err == nil {
+					fe.parser.RequireChecksum = capabilities&CAP_CHECKSUM != 0
+				}
+				select {
+				case fe.hello <- payload:
+				default:
+				}
+			} else if strings.HasPrefix(packet, "^PAD ") && len(packet) >= len("^PAD x$") {
 				var event KeyPressEvent
-				event.Key = string(receiveBuffer.Bytes()[5])
-				if ! fe.IgnoreKeypress {
-					fe.Keypresses <- event
+				event.Key = packet[5:6]
+				select {
+				case <-fe.ready:
+				default:
+					// Blocking here would delay the answer to HELLO.
+					fmt.Printf("frontend: ignoring keypress during startup\n")
+					continue
+				}
+				if time.Now().UnixNano() >= fe.ignoreUntil.Load() {
+					select {
+					case fe.Keypresses <- event:
+					case <-fe.closed:
+						return
+					}
 				}
 			}
-			receiveBuffer.Reset()
 
-		case <-secondPassed:
+		case <-fe.closed:
+			return
+
+		case <-secondPassed.C:
+			// Report framing and checksum errors once a minute, if any.
+			pings++
+			if stats := fe.Stats(); pings%60 == 0 && stats != reportedStats {
+				fmt.Printf("pinpad-frontend: %d packets, %d framing errors, %d checksum errors\n",
+					stats.Packets, stats.FramingErrors, stats.ChecksumErrors)
+				reportedStats = stats
+			}
 			if previousPing != "" {
 				fmt.Printf("pinpad-frontend did not PONG %s\n", previousPing)
 			}
@@ -158,9 +258,20 @@ func (fe *Frontend) Beep(kind beepkind) error {
 	return nil
 }
 
+// LcdSet displays text on the LCD. The text is mapped to the LCD charset and
+// word-wrapped, see Layout(). Only the first LCD_LINES lines are displayed,
+// use the Screen to scroll longer text. ICON_* runes are replaced by their
+// fallback text unless custom glyphs are enabled.
 func (fe *Frontend) LcdSet(text string) error {
+	lines := Layout(fe.expandIcons(text))
+	return fe.lcdSetLines(lines[0], lines[1])
+}
+
+// lcdSetLines sends two lines which are already in LCD charset and at most
+// LCD_WIDTH characters long to the frontend.
+func (fe *Frontend) lcdSetLines(top, bottom string) error {
 	maxlength := len("^LCD $") + 32
-	command := fmt.Sprintf("^LCD %s", text)
+	command := fmt.Sprintf("^LCD %s", lcdText(top, bottom))
 	for len(command) < maxlength {
 		command = fmt.Sprintf("%s ", command)
 	}
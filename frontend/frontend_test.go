@@ -7,6 +7,7 @@ package frontend
 import (
 	"bytes"
 	"pinpad-controller/testfrontend"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -41,3 +42,69 @@ func TestKeypresses(t *testing.T) {
 		}
 	}
 }
+
+// Verify that the firmware version and capabilities are negotiated.
+func TestHello(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	testfe.Hello = "^HI 0203$"
+	frontend := OpenFrontendish(testfe)
+	if frontend.Version != 2 {
+		t.Errorf("Expected firmware version 2, got %d", frontend.Version)
+	}
+	if !frontend.Has(CAP_GLYPHS) || !frontend.Has(CAP_CHECKSUM) {
+		t.Errorf("Expected glyphs and checksum capabilities, got %s", frontend.Capabilities)
+	}
+	if !frontend.CustomGlyphs {
+		t.Error("Custom glyphs were not enabled")
+	}
+
+	// Old firmware does not answer at all.
+	helloTimeout = 50 * time.Millisecond
+	testfe = testfrontend.NewTestFrontend()
+	testfe.Hello = ""
+	frontend = OpenFrontendish(testfe)
+	if frontend.Version != 0 || frontend.Capabilities != 0 {
+		t.Errorf("Expected no capabilities for old firmware, got version %d, %s",
+			frontend.Version, frontend.Capabilities)
+	}
+}
+
+// A key pressed during startup must not block the answer to HELLO.
+func TestHelloAfterKeypress(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	testfe.Hello = "^PAD 1  $^HI 0201$"
+	frontend := OpenFrontendish(testfe)
+	if frontend.Version != 2 || !frontend.Has(CAP_GLYPHS) {
+		t.Errorf("Expected firmware version 2 with glyphs, got version %d, %s",
+			frontend.Version, frontend.Capabilities)
+	}
+}
+
+func TestCapabilityString(t *testing.T) {
+	if s := Capability(0).String(); s != "none" {
+		t.Errorf("Unexpected string for no capabilities: %q", s)
+	}
+	if s := (CAP_GLYPHS | CAP_CHECKSUM | 0x80).String(); s != "glyphs,checksum,0x80" {
+		t.Errorf("Unexpected string for capabilities: %q", s)
+	}
+}
+
+// Verify that Close stops all Go functions of the frontend, including the one
+// which is blocked reading from the TTY.
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	testfe := testfrontend.NewTestFrontend()
+	frontend := OpenFrontendish(testfe)
+	if err := frontend.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing twice is fine.
+	frontend.Close()
+
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d Go functions still running after Close", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
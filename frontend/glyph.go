@@ -0,0 +1,113 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Custom LCD glyphs. The HD44780 has 8 user-definable characters (CGRAM) which
+// the frontend fills with the ^CGR command (see CAP_GLYPHS). In LCD text, the glyphs are
+// referenced by the ICON_* runes.
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type Glyph struct {
+	// The 5x8 bitmap, one byte per row from top to bottom. Only the lower 5
+	// bits of each row are used.
+	Rows [8]byte
+	// Shown instead of the glyph when the frontend does not support custom
+	// glyphs.
+	Fallback string
+}
+
+// Runes from the Unicode private use area which refer to the CGRAM slots 0 to
+// 7. They can be used in any LCD text.
+const (
+	ICON_LOCK_OPEN    = '\uE000'
+	ICON_LOCK_CLOSED  = '\uE001'
+	ICON_NETWORK_DOWN = '\uE002'
+	ICON_SYNC_WARNING = '\uE003'
+)
+
+const (
+	iconFirst = '\uE000'
+	iconLast  = '\uE007'
+)
+
+// The glyphs which are uploaded by EnableGlyphs.
+var Icons = map[rune]Glyph{
+	ICON_LOCK_OPEN: {
+		Rows:     [8]byte{0x0E, 0x10, 0x10, 0x1F, 0x1B, 0x1B, 0x1F, 0x00},
+		Fallback: "",
+	},
+	ICON_LOCK_CLOSED: {
+		Rows:     [8]byte{0x0E, 0x11, 0x11, 0x1F, 0x1B, 0x1B, 0x1F, 0x00},
+		Fallback: "",
+	},
+	ICON_NETWORK_DOWN: {
+		Rows:     [8]byte{0x11, 0x0A, 0x04, 0x0A, 0x11, 0x00, 0x1F, 0x00},
+		Fallback: "!",
+	},
+	ICON_SYNC_WARNING: {
+		Rows:     [8]byte{0x1F, 0x1B, 0x1B, 0x1B, 0x1F, 0x1B, 0x1F, 0x00},
+		Fallback: "!",
+	},
+}
+
+// glyphByte returns the byte which displays the CGRAM slot for the given icon
+// rune. The HD44780 maps both 0x00 to 0x07 and 0x08 to 0x0F to the CGRAM
+// slots. Slot 0 uses 0x08 because the frontend filters 0 bytes; the others
+// use 0x01 to 0x07, because 0x09 to 0x0D are whitespace for Layout.
+func glyphByte(icon rune) byte {
+	slot := byte(icon - iconFirst)
+	if slot == 0 {
+		return 0x08
+	}
+	return slot
+}
+
+// DefineGlyph uploads the glyph into the given CGRAM slot (0 to 7).
+func (fe *Frontend) DefineGlyph(slot int, glyph Glyph) error {
+	if slot < 0 || slot > int(iconLast-iconFirst) {
+		return fmt.Errorf("invalid CGRAM slot %d", slot)
+	}
+	command := fmt.Sprintf("^CGR %d %x", slot, glyph.Rows[:])
+	for len(command) < len("^CGR ")+32 {
+		command += " "
+	}
+	command += "$"
+	_, err := fe.tty.Write([]byte(command))
+	return err
+}
+
+// EnableGlyphs uploads all Icons to the frontend. Afterwards, the ICON_* runes
+// are displayed as glyphs instead of their fallback text. OpenFrontendish
+// calls this if the firmware supports custom glyphs.
+func (fe *Frontend) EnableGlyphs() error {
+	if !fe.Has(CAP_GLYPHS) {
+		return fmt.Errorf("frontend firmware does not support custom glyphs")
+	}
+	for icon, glyph := range Icons {
+		if err := fe.DefineGlyph(int(icon-iconFirst), glyph); err != nil {
+			return err
+		}
+	}
+	fe.CustomGlyphs = true
+	return nil
+}
+
+// expandIcons replaces the ICON_* runes in text with their fallback text
+// unless the frontend supports custom glyphs. fe may be nil.
+func (fe *Frontend) expandIcons(text string) string {
+	if fe != nil && fe.CustomGlyphs {
+		return text
+	}
+	var result bytes.Buffer
+	for _, r := range text {
+		if r < iconFirst || r > iconLast {
+			result.WriteRune(r)
+		} else if glyph, ok := Icons[r]; ok {
+			result.WriteString(glyph.Fallback)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,71 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the custom LCD glyphs.
+package frontend
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Records all packets which are written to the frontend.
+type recordingTTY struct {
+	bytes.Buffer
+}
+
+func (r *recordingTTY) Read(p []byte) (int, error) {
+	select {}
+}
+
+func TestDefineGlyph(t *testing.T) {
+	tty := new(recordingTTY)
+	fe := &Frontend{tty: tty}
+
+	if err := fe.DefineGlyph(1, Icons[ICON_LOCK_CLOSED]); err != nil {
+		t.Fatal(err)
+	}
+	want := "^CGR 1 0e11111f1b1b1f00" + "              $"
+	if got := tty.String(); got != want {
+		t.Errorf("Unexpected CGR packet: got %q, want %q", got, want)
+	}
+	if len(want) != 38 {
+		t.Errorf("CGR packet has the wrong length: %d", len(want))
+	}
+
+	if err := fe.DefineGlyph(8, Glyph{}); err == nil {
+		t.Error("CGRAM slot 8 was accepted")
+	}
+}
+
+func TestIconFallback(t *testing.T) {
+	text := string(ICON_SYNC_WARNING) + "Sync fail"
+
+	fe := &Frontend{tty: new(recordingTTY)}
+	if err := fe.EnableGlyphs(); err == nil {
+		t.Error("Glyphs enabled without CAP_GLYPHS")
+	}
+	if got := fe.expandIcons(text); got != "!Sync fail" {
+		t.Errorf("Unexpected fallback text: %q", got)
+	}
+
+	fe.Capabilities = CAP_GLYPHS
+	if err := fe.EnableGlyphs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := MapCharset(fe.expandIcons(text)); got != "\x03Sync fail" {
+		t.Errorf("Icon not mapped to its CGRAM slot: %q", got)
+	}
+}
+
+func TestIconLayout(t *testing.T) {
+	fe := &Frontend{tty: new(recordingTTY), Capabilities: CAP_GLYPHS}
+	if err := fe.EnableGlyphs(); err != nil {
+		t.Fatal(err)
+	}
+	for icon := range Icons {
+		lines := Layout(fe.expandIcons(string(icon) + " Closed"))
+		if want := string(glyphByte(icon)) + " Closed"; len(lines) != LCD_LINES || lines[0] != want || lines[1] != "" {
+			t.Errorf("Icon %U: got %q, want [%q \"\"]", icon, lines, want)
+		}
+	}
+}
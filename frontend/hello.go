@@ -0,0 +1,99 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Version and capability negotiation. When the frontend is opened, we send a
+// HELLO request. Firmware which knows about HELLO answers with
+//
+//	^HI vvcc$
+//
+// where vv is the firmware version and cc the bitmask of capabilities, both
+// as two hex digits. Older firmware does not answer at all, in which case we
+// only use the commands every firmware understands (PING, LCD, LCH, LED,
+// BEEP).
+package frontend
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Capability uint8
+
+const (
+	// The ^CGR command to define custom LCD glyphs.
+	CAP_GLYPHS = Capability(1 << 0)
+	// Inbound packets may carry a checksum.
+	CAP_CHECKSUM = Capability(1 << 1)
+)
+
+var capabilityNames = []struct {
+	capability Capability
+	name       string
+}{
+	{CAP_GLYPHS, "glyphs"},
+	{CAP_CHECKSUM, "checksum"},
+}
+
+// How long to wait for the answer to HELLO before assuming old firmware.
+var helloTimeout = 2 * time.Second
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.capability != 0 {
+			names = append(names, n.name)
+			c &^= n.capability
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%02x", uint8(c)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Has returns whether the frontend firmware announced the given capability.
+func (fe *Frontend) Has(capability Capability) bool {
+	return fe.Capabilities&capability == capability
+}
+
+// Hello asks the firmware for its version and capabilities. The answer is
+// handled by negotiate.
+func (fe *Frontend) Hello() error {
+	_, err := fe.tty.Write([]byte("^HELLO                               $"))
+	return err
+}
+
+// parseHello parses the payload of a ^HI packet.
+func parseHello(payload string) (version int, capabilities Capability, err error) {
+	var caps uint8
+	if _, err = fmt.Sscanf(payload, "%02x%02x", &version, &caps); err != nil {
+		return 0, 0, fmt.Errorf("invalid HI packet %q: %s", payload, err)
+	}
+	return version, Capability(caps), nil
+}
+
+// negotiate sends HELLO and waits for the answer. On timeout, Version and
+// Capabilities stay 0.
+func (fe *Frontend) negotiate() {
+	if err := fe.Hello(); err != nil {
+		fmt.Printf("frontend: cannot send HELLO: %s\n", err)
+		return
+	}
+
+	select {
+	case payload := <-fe.hello:
+		version, capabilities, err := parseHello(payload)
+		if err != nil {
+			fmt.Printf("frontend: %s\n", err)
+			return
+		}
+		fe.Version = version
+		fe.Capabilities = capabilities
+		fmt.Printf("frontend: firmware version %d, capabilities: %s\n", version, capabilities)
+	case <-time.After(helloTimeout):
+		fmt.Printf("frontend: no answer to HELLO, assuming old firmware\n")
+	}
+}
@@ -0,0 +1,137 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Text layout for the 2x16 LCD: characters are mapped to the HD44780 character
+// ROM (A00, the japanese variant which is on the common modules), text is
+// word-wrapped to LCD_WIDTH and split into lines.
+package frontend
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Characters which exist in the HD44780 A00 character ROM, but not at their
+// Latin-1 position.
+var romCharacters = map[rune]byte{
+	'ä': 0xE1,
+	'ö': 0xEF,
+	'ü': 0xF5,
+	'ß': 0xE2,
+	'µ': 0xE4,
+	'°': 0xDF,
+	'·': 0xA5,
+	'ñ': 0xEE,
+	'¢': 0xEC,
+	'÷': 0xFD,
+	'π': 0xF7,
+	'Ω': 0xF4,
+	'Σ': 0xF6,
+	'→': 0x7E,
+	'←': 0x7F,
+}
+
+// Characters which are not in the character ROM (or cannot be sent via the
+// protocol) and are replaced by one or more ASCII characters.
+var transliterations = map[rune]string{
+	'Ä': "Ae", 'Ö': "Oe", 'Ü': "Ue",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Å': "A", 'Æ': "AE",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a", 'æ': "ae",
+	'Ç': "C", 'ç': "c",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'Ñ': "N",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ø': "O",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ø': "o",
+	'Ù': "U", 'Ú': "U", 'Û': "U",
+	'ù': "u", 'ú': "u", 'û': "u",
+	'Ý': "Y", 'ý': "y", 'ÿ': "y",
+	'€': "EUR",
+	'„': "\"", '“': "\"", '”': "\"", '‚': "'", '‘': "'", '’': "'",
+	'–': "-", '—': "-", '…': "...",
+	// In the A00 ROM, 0x5C is the Yen sign and 0x7E is an arrow.
+	'\\': "/",
+	'~':  "-",
+	// ^ and $ delimit packets of the frontend protocol.
+	'^':  "'",
+	'$':  "S",
+	'\t': " ",
+}
+
+// MapCharset converts text to bytes of the HD44780 character ROM.
+// Characters which have no representation are replaced by '?'.
+func MapCharset(text string) string {
+	var result []byte
+	for _, r := range text {
+		if b, ok := romCharacters[r]; ok {
+			result = append(result, b)
+		} else if r >= iconFirst && r <= iconLast {
+			result = append(result, glyphByte(r))
+		} else if s, ok := transliterations[r]; ok {
+			result = append(result, s...)
+		} else if r == '\n' || (r >= ' ' && r < utf8.RuneSelf && r != 0x7F) {
+			result = append(result, byte(r))
+		} else {
+			result = append(result, '?')
+		}
+	}
+	return string(result)
+}
+
+// wrapLine word-wraps a single line (in LCD charset) to the given width.
+// Words which are longer than width are split.
+func wrapLine(line string, width int) []string {
+	var lines []string
+	current := ""
+	for _, word := range strings.Fields(line) {
+		for len(word) > width {
+			if current != "" {
+				lines = append(lines, current)
+				current = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+		if current == "" {
+			current = word
+		} else if len(current)+1+len(word) <= width {
+			current += " " + word
+		} else {
+			lines = append(lines, current)
+			current = word
+		}
+	}
+	if current != "" || len(lines) == 0 {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// Layout maps text to the LCD charset and splits it into lines of at most
+// LCD_WIDTH characters. Embedded newlines start a new line. The result has at
+// least LCD_LINES lines; if it has more, the text needs to be scrolled.
+func Layout(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(MapCharset(text), "\n") {
+		lines = append(lines, wrapLine(line, LCD_WIDTH)...)
+	}
+	for len(lines) < LCD_LINES {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// lcdText encodes two lines for the LCD packet. The frontend continues on the
+// second line after LCD_WIDTH characters, so a newline is only necessary if
+// the first line is shorter. This way, both lines always fit into the 32
+// characters of the packet.
+func lcdText(top, bottom string) string {
+	if len(top) < LCD_WIDTH {
+		if bottom == "" {
+			return top
+		}
+		return top + "\n" + bottom
+	}
+	return top + bottom
+}
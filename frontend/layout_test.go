@@ -0,0 +1,58 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the LCD text layout.
+package frontend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMapCharset(t *testing.T) {
+	tests := map[string]string{
+		"Open":         "Open",
+		"Grüße":        "Gr\xf5\xe2e",
+		"Ärger":        "Aerger",
+		"Café 5€":      "Cafe 5EUR",
+		"^PIN$":        "'PINS",
+		"\x01☃":        "??",
+		"10°C\nfertig": "10\xdfC\nfertig",
+	}
+	for input, want := range tests {
+		if got := MapCharset(input); got != want {
+			t.Errorf("MapCharset(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", []string{"", ""}},
+		{" \nOpen", []string{"", "Open"}},
+		{"Unlocking door...", []string{"Unlocking", "door..."}},
+		{"Welcome back, Stapelberg", []string{"Welcome back,", "Stapelberg"}},
+		{"Welcome back, Överlångsamtnamn!", []string{"Welcome back,", "Oeverlangsamtnam", "n!"}},
+		{"a b c\nd", []string{"a b c", "d"}},
+	}
+	for _, test := range tests {
+		if got := Layout(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Layout(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestLcdText(t *testing.T) {
+	if got := lcdText("Closed", ""); got != "Closed" {
+		t.Errorf("Unexpected text for one line: %q", got)
+	}
+	if got := lcdText("PIN:", "****"); got != "PIN:\n****" {
+		t.Errorf("Unexpected text for two lines: %q", got)
+	}
+	full := "0123456789abcdef"
+	if got := lcdText(full, full); len(got) != 32 {
+		t.Errorf("Two full lines do not fit into the packet: %q", got)
+	}
+}
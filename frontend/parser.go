@@ -0,0 +1,130 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Parser for the packets the frontend sends to us. A packet starts with '^',
+// ends with '$' and has at most maxPacketLength bytes, for example:
+//
+//	^PAD 2  $
+//
+// Firmware with CAP_CHECKSUM inserts '*' and two hex digits before the '$',
+// which are the XOR of all bytes between '^' and '*':
+//
+//	^PAD 2*1F$
+//
+// Whenever the parser encounters a '^', it starts a new packet, so that a
+// dropped byte only costs us the packet it was part of.
+package frontend
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// The longest packet we accept, including '^' and '$'.
+const maxPacketLength = 38
+
+type ParserStats struct {
+	// Number of valid packets.
+	Packets uint64
+	// Number of incomplete packets and garbage between packets.
+	FramingErrors uint64
+	// Number of packets with missing or wrong checksum.
+	ChecksumErrors uint64
+}
+
+type Parser struct {
+	// If true, packets without checksum are rejected.
+	RequireChecksum bool
+
+	buffer   []byte
+	inPacket bool
+	// Whether we are skipping garbage outside of a packet. Consecutive
+	// garbage bytes count as one framing error.
+	discarding bool
+
+	packets        uint64
+	framingErrors  uint64
+	checksumErrors uint64
+}
+
+// Stats returns the packet and error counters. It is safe to call Stats while
+// another Go function calls Feed.
+func (p *Parser) Stats() ParserStats {
+	return ParserStats{
+		Packets:        atomic.LoadUint64(&p.packets),
+		FramingErrors:  atomic.LoadUint64(&p.framingErrors),
+		ChecksumErrors: atomic.LoadUint64(&p.checksumErrors),
+	}
+}
+
+func (p *Parser) framingError(format string, args ...interface{}) error {
+	atomic.AddUint64(&p.framingErrors, 1)
+	return fmt.Errorf("framing error: "+format, args...)
+}
+
+// Feed adds the next byte to the parser. When b completes a valid packet, the
+// packet is returned (without checksum). An error is returned whenever bytes
+// had to be discarded.
+func (p *Parser) Feed(b byte) (packet string, err error) {
+	if b == '^' {
+		if p.inPacket {
+			err = p.framingError("incomplete packet %q", p.buffer)
+		}
+		p.buffer = append(p.buffer[:0], b)
+		p.inPacket = true
+		p.discarding = false
+		return "", err
+	}
+
+	if !p.inPacket {
+		if !p.discarding {
+			p.discarding = true
+			return "", p.framingError("unexpected byte %q outside of packet", b)
+		}
+		return "", nil
+	}
+
+	p.buffer = append(p.buffer, b)
+	if b != '$' {
+		if len(p.buffer) >= maxPacketLength {
+			p.inPacket = false
+			p.discarding = true
+			return "", p.framingError("packet %q too long", p.buffer)
+		}
+		return "", nil
+	}
+
+	p.inPacket = false
+	return p.verify(p.buffer)
+}
+
+// verify checks and strips the checksum of a complete packet.
+func (p *Parser) verify(raw []byte) (string, error) {
+	n := len(raw)
+	if n >= 5 && raw[n-4] == '*' {
+		if sum, err := strconv.ParseUint(string(raw[n-3:n-1]), 16, 8); err == nil {
+			if byte(sum) != Checksum(raw[1:n-4]) {
+				atomic.AddUint64(&p.checksumErrors, 1)
+				return "", fmt.Errorf("checksum mismatch in packet %q", raw)
+			}
+			atomic.AddUint64(&p.packets, 1)
+			return string(raw[:n-4]) + "$", nil
+		}
+	}
+
+	if p.RequireChecksum {
+		atomic.AddUint64(&p.checksumErrors, 1)
+		return "", fmt.Errorf("packet %q has no checksum", raw)
+	}
+	atomic.AddUint64(&p.packets, 1)
+	return string(raw), nil
+}
+
+// Checksum returns the XOR of all bytes of payload.
+func Checksum(payload []byte) byte {
+	var sum byte
+	for _, b := range payload {
+		sum ^= b
+	}
+	return sum
+}
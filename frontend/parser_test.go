@@ -0,0 +1,152 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the packet parser.
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"pinpad-controller/testfrontend"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Feeds input into p and returns all packets.
+func feedAll(p *Parser, input string) []string {
+	var packets []string
+	for i := 0; i < len(input); i++ {
+		if packet, _ := p.Feed(input[i]); packet != "" {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+func withChecksum(payload string) string {
+	return fmt.Sprintf("^%s*%02X$", payload, Checksum([]byte(payload)))
+}
+
+func TestParserResync(t *testing.T) {
+	var p Parser
+	// A packet with a dropped '$', garbage between packets, a dropped byte
+	// within a packet and a packet which is too long.
+	input := "^PAD 1  " + "^PAD 2  $" + "xx" + "^PAD 3 $" + "^" + strings.Repeat("A", 40) + "$" + "^PAD 4  $"
+	packets := feedAll(&p, input)
+	want := []string{"^PAD 2  $", "^PAD 3 $", "^PAD 4  $"}
+	if strings.Join(packets, "") != strings.Join(want, "") {
+		t.Errorf("Expected packets %q, got %q", want, packets)
+	}
+	stats := p.Stats()
+	if stats.Packets != 3 || stats.FramingErrors != 3 || stats.ChecksumErrors != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestParserChecksum(t *testing.T) {
+	var p Parser
+	valid := withChecksum("PAD 5")
+	corrupted := strings.Replace(withChecksum("PAD 6"), "6", "7", 1)
+	packets := feedAll(&p, valid+corrupted+"^PAD *  $")
+	if len(packets) != 2 || packets[0] != "^PAD 5$" || packets[1] != "^PAD *  $" {
+		t.Errorf("Unexpected packets: %q", packets)
+	}
+	if stats := p.Stats(); stats.ChecksumErrors != 1 {
+		t.Errorf("Expected one checksum error, got %+v", stats)
+	}
+
+	p.RequireChecksum = true
+	packets = feedAll(&p, "^PAD 8  $"+valid)
+	if len(packets) != 1 || packets[0] != "^PAD 5$" {
+		t.Errorf("Packet without checksum accepted: %q", packets)
+	}
+}
+
+func FuzzParser(f *testing.F) {
+	f.Add([]byte("^PAD 2  $^PONG ab$"))
+	f.Add([]byte("^PAD 2*1F$^^$$"))
+	f.Add([]byte("garbage^HI 0103$"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var p Parser
+		for _, b := range input {
+			packet, _ := p.Feed(b)
+			if packet == "" {
+				continue
+			}
+			if packet[0] != '^' || packet[len(packet)-1] != '$' ||
+				strings.Count(packet, "^") != 1 || len(packet) > maxPacketLength {
+				t.Fatalf("Invalid packet %q", packet)
+			}
+		}
+	})
+}
+
+// Waits until the given key was pressed, discarding all other keypresses.
+func waitForKey(fe *Frontend, key string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case keypress := <-fe.Keypresses:
+			if keypress.Key == key {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Verify that keypresses are recognized even if they are surrounded by random
+// garbage.
+func TestKeypressesWithNoise(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := OpenFrontendish(testfe)
+
+	noise := rand.New(rand.NewSource(42))
+	var stream bytes.Buffer
+	keys := "0123456789*#"
+	for i := 0; i < 100; i++ {
+		garbage := make([]byte, noise.Intn(20))
+		noise.Read(garbage)
+		stream.Write(garbage)
+		fmt.Fprintf(&stream, "^PAD %c  $", keys[i%len(keys)])
+	}
+	testfe.FillBuffer(stream.String())
+
+	var received bytes.Buffer
+	timeout := time.After(2 * time.Second)
+	for received.Len() < 100 {
+		select {
+		case keypress := <-frontend.Keypresses:
+			received.WriteString(keypress.Key)
+		case <-timeout:
+			t.Fatalf("Only received %d of 100 keypresses within 2s", received.Len())
+		}
+	}
+	if !strings.HasPrefix(received.String(), keys) {
+		t.Errorf("Keypresses out of order: %q", received.String())
+	}
+	if frontend.Stats().FramingErrors == 0 {
+		t.Error("No framing errors counted for the garbage")
+	}
+}
+
+// Feeds random byte streams through the TestFrontend and verifies that the
+// next valid keypress is still recognized.
+func FuzzFrontend(f *testing.F) {
+	f.Add([]byte("^PAD 1  "))
+	f.Add([]byte("^^^$$$"))
+	f.Add([]byte("^PONG"))
+	f.Add([]byte("^HI 0102$"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		testfe := testfrontend.NewTestFrontend()
+		frontend := OpenFrontendish(testfe)
+		defer frontend.Close()
+		// With checksum, in case the input announced CAP_CHECKSUM.
+		testfe.FillBuffer(string(input) + withChecksum("PAD 7"))
+		if !waitForKey(frontend, "7", time.Second) {
+			t.Fatalf("Keypress after %q was lost", input)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Regression tests which replay captures from the field.
+package frontend
+
+import (
+	"bytes"
+	"os"
+	"pinpad-controller/testfrontend"
+	"pinpad-controller/uart"
+	"testing"
+	"time"
+)
+
+// Replays the capture and returns the keys which were pressed.
+func replayKeypresses(t *testing.T, filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := uart.ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keypresses during startup are dropped, so replay once the frontend
+	// is set up.
+	testfe := testfrontend.NewReplayFrontend()
+	frontend := OpenFrontendish(testfe)
+	go testfe.Replay(entries, 0)
+
+	var keys bytes.Buffer
+	for {
+		select {
+		case keypress := <-frontend.Keypresses:
+			keys.WriteString(keypress.Key)
+		case <-time.After(250 * time.Millisecond):
+			return keys.String()
+		}
+	}
+}
+
+// A keypress split across two reads and a truncated packet.
+func TestReplayKeypad(t *testing.T) {
+	if keys := replayKeypresses(t, "testdata/keypad.capture"); keys != "1234#" {
+		t.Errorf("Expected keypresses 1234#, got %q", keys)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	var capture bytes.Buffer
+	recorder := uart.NewRecorder(testfe, &capture)
+
+	testfe.FillBuffer("^PAD 1  $")
+	buf := make([]byte, 1)
+	for i := 0; i < len("^PAD 1  $"); i++ {
+		recorder.Read(buf)
+	}
+	recorder.Write([]byte("^BEEP 1$"))
+
+	entries, err := uart.ReadCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(entries))
+	}
+	last := entries[len(entries)-1]
+	if last.Direction != uart.OUTBOUND || string(last.Data) != "^BEEP 1$" {
+		t.Errorf("Unexpected last entry: %c %q", last.Direction, last.Data)
+	}
+	if entries[0].Direction != uart.INBOUND || string(entries[0].Data) != "^" {
+		t.Errorf("Unexpected first entry: %c %q", entries[0].Direction, entries[0].Data)
+	}
+	if string(entries[5].Data) != "x" {
+		t.Errorf("Keypad digit not masked: %q", entries[5].Data)
+	}
+
+	testfe.FillBuffer("^PAD 2  $")
+	var read []byte
+	for len(read) < len("^PAD 2  $") {
+		n, _ := recorder.Read(buf)
+		read = append(read, buf[:n]...)
+	}
+	if string(read) != "^PAD 2  $" {
+		t.Errorf("Masking modified the data read: %q", read)
+	}
+}
@@ -0,0 +1,212 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The screen manager owns the LCD of a frontend. Components no longer write to
+// the LCD directly, instead they push messages with a priority and an expiry
+// on top of the base view (door state, clock, sync warning). The screen
+// manager decides what is visible and only talks to the frontend when the
+// visible content changes.
+package frontend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Priority int
+
+const (
+	PRIO_LOW    = Priority(0)
+	PRIO_NORMAL = Priority(1)
+	PRIO_HIGH   = Priority(2)
+)
+
+// The LCD has 2 lines with 16 characters each.
+const (
+	LCD_LINES = 2
+	LCD_WIDTH = 16
+)
+
+// Messages with more than LCD_LINES lines are scrolled by one line every
+// scrollInterval.
+const scrollInterval = 1500 * time.Millisecond
+
+type message struct {
+	// The laid out text, see Layout().
+	lines    []string
+	priority Priority
+	// The zero time means the message never expires.
+	expires time.Time
+	// Messages with the same priority are ordered by seq, the most recent
+	// message wins.
+	seq uint64
+	// When the message was shown, the scroll position is relative to this.
+	since time.Time
+}
+
+type Screen struct {
+	fe *Frontend
+
+	mu sync.Mutex
+	// Whether the door state is known at all, and if so, whether it is open.
+	doorKnown bool
+	doorOpen  bool
+	// Shown in the first line of the base view, empty if everything is fine.
+	warning  string
+	messages map[string]*message
+	seq      uint64
+	// The lines which are currently on the LCD.
+	shown [LCD_LINES]string
+
+	wake chan bool
+}
+
+// NewScreen creates a screen manager for the given frontend and starts the Go
+// function which renders the LCD contents.
+func NewScreen(fe *Frontend) *Screen {
+	s := new(Screen)
+	s.fe = fe
+	s.messages = make(map[string]*message)
+	s.wake = make(chan bool, 1)
+	go s.run()
+	return s
+}
+
+// Show displays text on top of the base view until it is replaced, hidden or
+// the duration passed. A duration of 0 means the message stays until it is
+// hidden. Showing a message with an id that is already in use replaces the
+// previous message. Text which does not fit on the LCD is scrolled.
+func (s *Screen) Show(id string, text string, priority Priority, duration time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	s.seq++
+	m := &message{lines: Layout(s.fe.expandIcons(text)), priority: priority, seq: s.seq, since: now}
+	if duration > 0 {
+		m.expires = now.Add(duration)
+	}
+	s.messages[id] = m
+	s.mu.Unlock()
+	s.update()
+}
+
+// Hide removes the message with the given id, if any.
+func (s *Screen) Hide(id string) {
+	s.mu.Lock()
+	delete(s.messages, id)
+	s.mu.Unlock()
+	s.update()
+}
+
+// SetDoor updates the door state which is shown in the base view.
+func (s *Screen) SetDoor(open bool) {
+	s.mu.Lock()
+	s.doorKnown = true
+	s.doorOpen = open
+	s.mu.Unlock()
+	s.update()
+}
+
+// SetWarning sets the warning shown in the base view (for example when the
+// PIN sync fails). The empty string clears the warning.
+func (s *Screen) SetWarning(warning string) {
+	s.mu.Lock()
+	s.warning = warning
+	s.mu.Unlock()
+	s.update()
+}
+
+func (s *Screen) update() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// render returns the lines which should be on the LCD at the given time and
+// the time at which the contents need to be re-evaluated. Expired messages are
+// removed. Must be called with s.mu held.
+func (s *Screen) render(now time.Time) (lines [LCD_LINES]string, next time.Time) {
+	// The clock in the base view changes every minute.
+	next = now.Truncate(time.Minute).Add(time.Minute)
+
+	var top *message
+	for id, m := range s.messages {
+		if !m.expires.IsZero() && !now.Before(m.expires) {
+			delete(s.messages, id)
+			continue
+		}
+		if !m.expires.IsZero() && m.expires.Before(next) {
+			next = m.expires
+		}
+		if top == nil ||
+			m.priority > top.priority ||
+			(m.priority == top.priority && m.seq > top.seq) {
+			top = m
+		}
+	}
+
+	if top == nil {
+		return s.baseView(now), next
+	}
+
+	offset := 0
+	if scrollPositions := len(top.lines) - LCD_LINES + 1; scrollPositions > 1 {
+		step := int(now.Sub(top.since) / scrollInterval)
+		offset = step % scrollPositions
+		if scroll := top.since.Add(time.Duration(step+1) * scrollInterval); scroll.Before(next) {
+			next = scroll
+		}
+	}
+	copy(lines[:], top.lines[offset:])
+	return lines, next
+}
+
+// baseView renders the door state in the second line and the warning (if any)
+// together with the clock in the first line:
+//
+//	!Sync fail 13:37
+//	Closed
+func (s *Screen) baseView(now time.Time) [LCD_LINES]string {
+	door := ""
+	if s.doorKnown {
+		if s.doorOpen {
+			door = string(ICON_LOCK_OPEN) + " Open"
+		} else {
+			door = string(ICON_LOCK_CLOSED) + " Closed"
+		}
+	}
+	door = Layout(s.fe.expandIcons(door))[0]
+	warning := Layout(s.fe.expandIcons(s.warning))[0]
+	if len(warning) > LCD_WIDTH-6 {
+		warning = warning[:LCD_WIDTH-6]
+	}
+	status := fmt.Sprintf("%-10s%6s", warning, now.Format("15:04"))
+	return [LCD_LINES]string{status, door}
+}
+
+// run re-renders the LCD whenever the contents change or a message expires.
+func (s *Screen) run() {
+	for {
+		s.mu.Lock()
+		lines, next := s.render(time.Now())
+		changed := lines != s.shown
+		s.shown = lines
+		s.mu.Unlock()
+
+		if changed {
+			if err := s.fe.lcdSetLines(lines[0], lines[1]); err != nil {
+				fmt.Printf("screen: could not set LCD: %s\n", err)
+			}
+		}
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		case <-s.fe.closed:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
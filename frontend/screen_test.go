@@ -0,0 +1,93 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the screen manager.
+package frontend
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns a Screen without the render Go function so that render() can be
+// called with arbitrary times.
+func newTestScreen() *Screen {
+	s := new(Screen)
+	s.messages = make(map[string]*message)
+	s.wake = make(chan bool, 1)
+	return s
+}
+
+func TestScreenBaseView(t *testing.T) {
+	s := newTestScreen()
+	now := time.Date(2013, 1, 1, 13, 37, 5, 0, time.Local)
+
+	if text, _ := s.render(now); text != [LCD_LINES]string{"           13:37", ""} {
+		t.Errorf("Unexpected base view without door state: %q", text)
+	}
+
+	s.SetDoor(true)
+	s.SetWarning("Sync fail")
+	text, next := s.render(now)
+	if text != [LCD_LINES]string{"Sync fail  13:37", "Open"} {
+		t.Errorf("Unexpected base view: %q", text)
+	}
+	if !next.Equal(time.Date(2013, 1, 1, 13, 38, 0, 0, time.Local)) {
+		t.Errorf("Clock not re-rendered at the next minute, next = %s", next)
+	}
+}
+
+func TestScreenPriorities(t *testing.T) {
+	s := newTestScreen()
+	s.SetDoor(false)
+
+	s.Show("pin", "PIN: **", PRIO_NORMAL, 10*time.Second)
+	s.Show("info", "Hello", PRIO_LOW, 0)
+	if text, _ := s.render(time.Now()); text[0] != "PIN: **" {
+		t.Errorf("Expected the higher priority message, got %q", text)
+	}
+
+	// Replacing a message by id keeps only the new one.
+	s.Show("pin", "Invalid PIN!", PRIO_HIGH, 2*time.Second)
+	if text, _ := s.render(time.Now()); text[0] != "Invalid PIN!" {
+		t.Errorf("Expected the replaced message, got %q", text)
+	}
+
+	// After the message expired, the next one is visible again.
+	text, next := s.render(time.Now().Add(3 * time.Second))
+	if text[0] != "Hello" {
+		t.Errorf("Expected the low priority message after expiry, got %q", text)
+	}
+	if _, ok := s.messages["pin"]; ok {
+		t.Error("Expired message was not removed")
+	}
+	if next.IsZero() {
+		t.Error("No re-render time returned")
+	}
+
+	s.Hide("info")
+	if text, _ := s.render(time.Now()); text != s.baseView(time.Now()) {
+		t.Errorf("Expected the base view after hiding all messages, got %q", text)
+	}
+}
+
+func TestScreenScrolling(t *testing.T) {
+	s := newTestScreen()
+	s.Show("welcome", "Unlocking door\nWelcome back, Stapelberg", PRIO_HIGH, 0)
+	since := s.messages["welcome"].since
+
+	expected := [][LCD_LINES]string{
+		{"Unlocking door", "Welcome back,"},
+		{"Welcome back,", "Stapelberg"},
+		{"Unlocking door", "Welcome back,"},
+	}
+	for step, want := range expected {
+		now := since.Add(time.Duration(step)*scrollInterval + time.Millisecond)
+		lines, next := s.render(now)
+		if lines != want {
+			t.Errorf("step %d: expected %q, got %q", step, want, lines)
+		}
+		if next.After(since.Add(time.Duration(step+1) * scrollInterval)) {
+			t.Errorf("step %d: next scroll at the wrong time: %s", step, next)
+		}
+	}
+}
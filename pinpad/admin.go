@@ -0,0 +1,64 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The admin menu of the keypad, reachable with **PIN# for PINs with the admin
+// permission. It allows dealing with a quarantined PIN update without a
+// laptop:
+//
+//	1  confirm the quarantined PIN update
+//	2  reject the quarantined PIN update
+//	3  show the number of PINs and whether an update is in quarantine
+//
+// Any other key (or no key within adminTimeout) leaves the menu.
+package pinpad
+
+import (
+	"fmt"
+	"pinpad-controller/events"
+	"pinpad-controller/frontend"
+	"pinpad-controller/pinstore"
+	"time"
+)
+
+const adminTimeout = 10 * time.Second
+
+func adminMenu(ps *pinstore.Pinstore, fe *frontend.Frontend, handle string) {
+	events.Publish("admin.menu", "%s entered the admin menu", handle)
+	fe.Screen.Show("pin", "1 confirm PINs\n2 reject 3 info", frontend.PRIO_HIGH, adminTimeout)
+
+	var key string
+	select {
+	case keypress := <-fe.Keypresses:
+		key = keypress.Key
+		fe.Beep(2)
+	case <-time.After(adminTimeout):
+		fe.Screen.Hide("pin")
+		return
+	}
+
+	result := "Admin menu left"
+	var err error
+	switch key {
+	case "1":
+		if err = ps.Confirm(); err == nil {
+			result = "PINs confirmed"
+		}
+	case "2":
+		if err = ps.Reject(); err == nil {
+			result = "PINs rejected"
+		}
+	case "3":
+		result = fmt.Sprintf("%d PINs\n", ps.Snapshot().Len())
+		if ps.Quarantined() != nil {
+			result += "Update held"
+		} else {
+			result += "No update held"
+		}
+	}
+	if err == pinstore.ErrNoQuarantine {
+		result = "No update held"
+	} else if err != nil {
+		fmt.Printf("admin menu: %s\n", err)
+		result = "Failed"
+	}
+	fe.Screen.Show("pin", result, frontend.PRIO_HIGH, 5*time.Second)
+}
@@ -1,39 +1,157 @@
 // vim:ts=4:sw=4:noexpandtab
+//
+// The keypad logic. What a user enters is interpreted as follows:
+//
+//	PIN#          open the door
+//	*PIN#         lock the door
+//	**PIN#        admin menu (see admin.go)
+//	id*code#      open the door with a TOTP code (also *id*code# etc.)
+//
+// Whether the PIN may do that depends on its role (see pinstore/roles.go).
 package pinpad
 
 import (
 	"bytes"
 	"fmt"
+	"pinpad-controller/events"
 	"pinpad-controller/frontend"
 	"pinpad-controller/pinstore"
-	"pinpad-controller/tuerstatus"
 	"regexp"
+	"strings"
 	"time"
 )
 
 // Valid Pins consist of numbers only
 var validPin, _ = regexp.Compile("^[0-9]+$")
 
+// How long the entered PIN stays on the LCD after the last keypress.
+const pinEntryTimeout = 10 * time.Second
+
+// Policy describes what a keypad may be used for.
+type Policy struct {
+	// The role of the keypad, used in log messages.
+	Role string
+	// If true, pressing # without entering a PIN locks the door. This is
+	// meant for keypads inside the space.
+	CloseWithoutPin bool
+	// If not empty, anyone can lock the door by entering ClosePin#.
+	// Otherwise, locking requires a PIN with close permission.
+	ClosePin string
+	// If not empty, PINs without PERM_OUTSIDE_SCHEDULE can only open the
+	// door within these windows.
+	OpenHours []pinstore.Window
+	// If true, rejected PINs look like unknown ones (and are throttled
+	// alike), so that the keypad does not tell which PINs exist. The
+	// reason is only logged. This is meant for keypads outside the space.
+	HideReasons bool
+}
+
+// The policies for the roles which can be configured for a frontend.
+var Policies = map[string]Policy{
+	"outside": {Role: "outside", ClosePin: "666", HideReasons: true},
+	"inside":  {Role: "inside", CloseWithoutPin: true, ClosePin: "666"},
+}
+
+type action int
+
+const (
+	ACTION_OPEN = action(iota)
+	ACTION_CLOSE
+	ACTION_ADMIN
+)
+
+// The permission which each action requires.
+var permissions = map[action]pinstore.Permission{
+	ACTION_OPEN:  pinstore.PERM_OPEN,
+	ACTION_CLOSE: pinstore.PERM_CLOSE,
+	ACTION_ADMIN: pinstore.PERM_ADMIN,
+}
+
+// Splits the input into the action (given by leading stars) and the
+// credentials.
+func parseInput(input string) (action, string) {
+	if strings.HasPrefix(input, "**") {
+		return ACTION_ADMIN, input[2:]
+	}
+	if strings.HasPrefix(input, "*") {
+		return ACTION_CLOSE, input[1:]
+	}
+	return ACTION_OPEN, input
+}
+
+// Keypad is a frontend together with its policy.
+type Keypad struct {
+	Frontend *frontend.Frontend
+	Policy   Policy
+}
+
 func invalidPin(pin string, fe *frontend.Frontend) {
 	fmt.Printf("Invalid PIN: %s\n", pin)
-	fe.LcdSet("Invalid PIN!")
+	fe.Screen.Show("pin", "Invalid PIN!", frontend.PRIO_HIGH, 2*time.Second)
+	fe.LED(2, 3000)
+	fe.IgnoreKeypresses(2 * time.Second)
+}
+
+// Shows why a known PIN was rejected, unless the policy hides the reasons.
+func rejected(keypad Keypad, message string) {
+	fe := keypad.Frontend
+	if keypad.Policy.HideReasons {
+		fe.Screen.Show("pin", "Invalid PIN!", frontend.PRIO_HIGH, 2*time.Second)
+		fe.LED(2, 3000)
+		fe.IgnoreKeypresses(2 * time.Second)
+		return
+	}
+	fe.Screen.Show("pin", message, frontend.PRIO_HIGH, 2*time.Second)
 	fe.LED(2, 3000)
-	go func() {
-		fe.IgnoreKeypress = true
-		time.Sleep(2 * time.Second)
-		if tuerstatus.CurrentStatus().Open {
-			fe.LcdSet(" \nOpen")
-		} else {
-			fe.LcdSet(" \nClosed")
-		}
-		fe.IgnoreKeypress = false
-	}()
+}
+
+// Tells why the PIN of entry was rejected.
+func rejectedPin(keypad Keypad, entry *pinstore.Entry, err error) {
+	fmt.Printf("%s: PIN of %s rejected: %s\n", keypad.Policy.Role, entry.Handle, err)
+	message := "PIN not valid\nat this time"
+	if err == pinstore.ErrExpired {
+		message = "PIN expired"
+	} else if err == pinstore.ErrUsedUp {
+		message = "PIN used up"
+	} else if err == pinstore.ErrReplayed {
+		message = "Code already used"
+	}
+	rejected(keypad, message)
+}
+
+func closeDoor(fe *frontend.Frontend, ht chan string) {
+	fe.Screen.Show("pin", "Locking door...", frontend.PRIO_HIGH, 5*time.Second)
+	fe.LED(3, 3000)
+	fe.LED(2, 1)
+	ht <- "close"
 }
 
 // Reads keypresses from the specified frontend, verifies entered pins using
 // the given pinstore and sends open/close commands to the specified hometec
-// channel.
+// channel. The frontend is treated as the outside keypad.
 func ValidatePin(ps *pinstore.Pinstore, fe *frontend.Frontend, ht chan string) {
+	ValidatePins(ps, []Keypad{{fe, Policies["outside"]}}, ht)
+}
+
+// Like ValidatePin, but for multiple keypads, each of which is handled
+// according to its policy. Commands of all keypads go to the same hometec
+// channel.
+func ValidatePins(ps *pinstore.Pinstore, keypads []Keypad, ht chan string) {
+	done := make(chan bool)
+	for _, keypad := range keypads {
+		go func(keypad Keypad) {
+			validateKeypad(ps, keypad, ht)
+			done <- true
+		}(keypad)
+	}
+	for range keypads {
+		<-done
+	}
+}
+
+func validateKeypad(ps *pinstore.Pinstore, keypad Keypad, ht chan string) {
+	fe := keypad.Frontend
+	role := keypad.Policy.Role
 	var keypressBuffer bytes.Buffer
 	for {
 		keypress := <-fe.Keypresses
@@ -41,43 +159,98 @@ func ValidatePin(ps *pinstore.Pinstore, fe *frontend.Frontend, ht chan string) {
 		fe.LED(1, 50)
 		fe.Beep(2)
 		if b[0] != byte('#') {
-			if keypressBuffer.Len() == 0 {
-				fe.LcdSet("PIN: *")
-			} else {
-				fe.LcdPut("*")
-			}
 			keypressBuffer.WriteByte(b[0])
+			fe.Screen.Show("pin", "PIN: "+strings.Repeat("*", keypressBuffer.Len()),
+				frontend.PRIO_NORMAL, pinEntryTimeout)
 			continue
 		}
 
-		pin := keypressBuffer.String()
+		input := keypressBuffer.String()
 		keypressBuffer.Reset()
 
-		if pin == "666" {
-			fmt.Printf("Got close pin, locking door\n")
-			fe.LcdSet("Locking door...")
-			fe.LED(3, 3000)
-			fe.LED(2, 1)
-			ht <- "close"
+		if input == "" && keypad.Policy.CloseWithoutPin {
+			fmt.Printf("%s: # pressed, locking door\n", role)
+			closeDoor(fe, ht)
 			continue
 		}
 
-		if len(pin) != 6 || !validPin.Match([]byte(pin)) {
-			invalidPin(pin, fe)
+		if keypad.Policy.ClosePin != "" && input == keypad.Policy.ClosePin {
+			fmt.Printf("%s: Got close pin, locking door\n", role)
+			closeDoor(fe, ht)
 			continue
 		}
 
-		// The pin is complete, let’s validate it.
-		if handle, ok := ps.Pins[pin]; ok {
-			fmt.Printf("%s unlocked the door\n", handle)
-			fe.LcdSet("Unlocking door...")
+		act, pin := parseInput(input)
+		now := time.Now()
+		var entry *pinstore.Entry
+		var err error
+		// The PIN (or TOTP code) is only used once the action is allowed,
+		// so that e.g. a guest who tries to lock the door does not use up
+		// the PIN.
+		idx := strings.Index(pin, "*")
+		if idx > 0 {
+			// member id*TOTP code
+			entry, err = ps.CheckTOTP(pin[:idx], pin[idx+1:], now)
+		} else if len(pin) != 6 || !validPin.Match([]byte(pin)) {
+			invalidPin(input, fe)
+			continue
+		} else {
+			// The duress PIN raises the alarm in any case, even if the
+			// entry is not valid at this time or used up.
+			if duress, ok := ps.Snapshot().LookupDuress(pin); ok {
+				events.Publish("alarm.duress", "%s entered the duress PIN on the %s keypad (PINs generation %d)",
+					duress.Handle, role, duress.Generation)
+			}
+			// The pin is complete, let’s validate it.
+			entry, err = ps.Check(pin, now)
+		}
+		if err == pinstore.ErrUnknownPin {
+			fmt.Printf("No such PIN: %s\n", input)
+			invalidPin(input, fe)
+			continue
+		}
+		if err != nil {
+			rejectedPin(keypad, entry, err)
+			continue
+		}
+
+		handle := entry.Handle
+		if !entry.Can(permissions[act]) {
+			fmt.Printf("%s: %s (role %s) may not do that\n", role, handle, entry.Role)
+			rejected(keypad, "Not allowed")
+			continue
+		}
+		if act == ACTION_OPEN && !entry.Can(pinstore.PERM_OUTSIDE_SCHEDULE) &&
+			!pinstore.InWindows(keypad.Policy.OpenHours, now) {
+			fmt.Printf("%s: %s may not open outside of the opening hours\n", role, handle)
+			rejected(keypad, "Outside of\nopening hours")
+			continue
+		}
+
+		if idx > 0 {
+			_, err = ps.UseTOTP(pin[:idx], pin[idx+1:], now)
+		} else {
+			_, err = ps.Use(pin, now)
+		}
+		if err != nil {
+			// E.g. used up on another keypad in the meantime.
+			rejectedPin(keypad, entry, err)
+			continue
+		}
+
+		switch act {
+		case ACTION_CLOSE:
+			fmt.Printf("%s: %s locked the door\n", role, handle)
+			closeDoor(fe, ht)
+		case ACTION_ADMIN:
+			adminMenu(ps, fe, handle)
+		case ACTION_OPEN:
+			fmt.Printf("%s: %s unlocked the door (PINs generation %d)\n", role, handle, entry.Generation)
+			fe.Screen.Show("pin", "Unlocking door\nWelcome back, "+handle,
+				frontend.PRIO_HIGH, 5*time.Second)
 			fe.LED(3, 3000)
 			fe.LED(2, 1)
 			ht <- "open"
-			continue
 		}
-
-		fmt.Printf("No such PIN: %s\n", pin)
-		invalidPin(pin, fe)
 	}
 }
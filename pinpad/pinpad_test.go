@@ -6,10 +6,15 @@ package pinpad
 
 import (
 	"bytes"
+	"encoding/base32"
 	"fmt"
+	"io/ioutil"
+	"path"
+	"pinpad-controller/events"
 	"pinpad-controller/frontend"
 	"pinpad-controller/pinstore"
 	"pinpad-controller/testfrontend"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,12 +50,25 @@ func constructPinBuffer(pin string) string {
 	return buffer.String()
 }
 
+// Loads a Pinstore with the given PIN list from a temporary file, which is
+// removed when the test is done.
+func loadPins(t *testing.T, contents string) *pinstore.Pinstore {
+	filename := path.Join(t.TempDir(), "pins.json")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := pinstore.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pins
+}
+
 func TestPinValidation(t *testing.T) {
 	testfe := testfrontend.NewTestFrontend()
 	frontend := frontend.OpenFrontendish(testfe)
 
-	pins := pinstore.Load("/tmp/testcase")
-	pins.Pins["123456"] = "secure"
+	pins := loadPins(t, `[{"handle": "secure", "pin": "123456"}]`)
 
 	hometec := make(chan string)
 	go ValidatePin(pins, frontend, hometec)
@@ -66,3 +84,222 @@ func TestPinValidation(t *testing.T) {
 		t.Error("Hometec got an instruction for an invalid pin")
 	}
 }
+
+func TestInsideKeypad(t *testing.T) {
+	outsidefe := testfrontend.NewTestFrontend()
+	insidefe := testfrontend.NewTestFrontend()
+	keypads := []Keypad{
+		{frontend.OpenFrontendish(outsidefe), Policies["outside"]},
+		{frontend.OpenFrontendish(insidefe), Policies["inside"]},
+	}
+
+	pins, _ := pinstore.Load("/tmp/testcase")
+
+	hometec := make(chan string)
+	go ValidatePins(pins, keypads, hometec)
+
+	if _, ok := resultWithBuffer(outsidefe, "^PAD #  $", hometec); ok {
+		t.Error("Hometec got an instruction for # on the outside keypad")
+	}
+
+	if cmd, ok := resultWithBuffer(insidefe, "^PAD #  $", hometec); !ok || cmd != "close" {
+		t.Errorf("Expected close for # on the inside keypad, got %q", cmd)
+	}
+}
+
+func TestExpiredPin(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	pins := loadPins(t, `[{"handle": "guest", "pin": "123456", "valid_until": "`+expired+`"}]`)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("123456"), hometec); ok {
+		t.Error("Hometec got an instruction for an expired pin")
+	}
+}
+
+func TestSingleUsePin(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+
+	pins := loadPins(t, `[{"handle": "delivery", "pin": "123456", "max_uses": 1}]`)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("123456"), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open for the first use, got %q", cmd)
+	}
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("123456"), hometec); ok {
+		t.Error("Hometec got an instruction for a used up pin")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+
+	secret := []byte("12345678901234567890")
+	pins := loadPins(t, `[{"handle": "secure", "id": "42", "totp": "`+
+		base32.StdEncoding.EncodeToString(secret)+`"}]`)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	code := pinstore.TOTPCode(secret, time.Now())
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("42*"+code), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open for a valid TOTP code, got %q", cmd)
+	}
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("42*"+code), hometec); ok {
+		t.Error("Hometec got an instruction for a replayed TOTP code")
+	}
+}
+
+func TestDuressPin(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+
+	pins := loadPins(t, `[{"handle": "secure", "pin": "123456", "duress_pin": "654321"}]`)
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("123456"), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open for the normal PIN, got %q", cmd)
+	}
+	if len(ch) != 0 {
+		t.Fatalf("Unexpected event %v for the normal PIN", <-ch)
+	}
+
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("654321"), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open for the duress PIN, got %q", cmd)
+	}
+	if event := <-ch; event.Type != "alarm.duress" || !strings.Contains(event.Message, "secure") {
+		t.Errorf("Unexpected event %v", event)
+	}
+}
+
+func TestDuressPinRejected(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+	pins := loadPins(t, `[
+	{"handle": "expired", "pin": "123456", "duress_pin": "654321", "valid_until": "2001-01-01T00:00:00Z"},
+	{"handle": "delivery", "pin": "111111", "duress_pin": "222222", "max_uses": 1}
+	]`)
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("654321"), hometec); ok {
+		t.Error("Hometec got an instruction for an expired duress PIN")
+	}
+	if event := <-ch; event.Type != "alarm.duress" || !strings.Contains(event.Message, "expired") {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	// The duress PIN counts towards max_uses of the entry…
+	frontend.IgnoreKeypresses(0)
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("111111"), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open for the normal PIN, got %q", cmd)
+	}
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("222222"), hometec); ok {
+		t.Error("Hometec got an instruction for a used up duress PIN")
+	}
+	// …and still raises the alarm.
+	if event := <-ch; event.Type != "alarm.duress" || !strings.Contains(event.Message, "delivery") {
+		t.Errorf("Unexpected event %v", event)
+	}
+}
+
+func TestRejectedActionKeepsUse(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+	pins := loadPins(t, `[{"handle": "guest", "pin": "111111", "role": "guest", "max_uses": 1}]`)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	// Guests may not lock the door…
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("*111111"), hometec); ok {
+		t.Error("Hometec got an instruction for a guest locking the door")
+	}
+	if uses := pins.Uses("111111"); uses != 0 {
+		t.Errorf("Rejected action counted as use: %d uses", uses)
+	}
+	// …but the PIN still opens it.
+	frontend.IgnoreKeypresses(0)
+	if cmd, ok := resultWithBuffer(testfe, constructPinBuffer("111111"), hometec); !ok || cmd != "open" {
+		t.Fatalf("Expected open, got %q", cmd)
+	}
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("111111"), hometec); ok {
+		t.Error("Hometec got an instruction for a used up PIN")
+	}
+}
+
+func TestRejectedLooksInvalidOutside(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	frontend := frontend.OpenFrontendish(testfe)
+	pins := loadPins(t, `[{"handle": "expired", "pin": "123456", "valid_until": "2001-01-01T00:00:00Z"}]`)
+
+	hometec := make(chan string)
+	go ValidatePin(pins, frontend, hometec)
+
+	if _, ok := resultWithBuffer(testfe, constructPinBuffer("123456"), hometec); ok {
+		t.Error("Hometec got an instruction for an expired PIN")
+	}
+	written := strings.Join(testfe.Written(), "\n")
+	if !strings.Contains(written, "Invalid PIN!") || strings.Contains(written, "expired") {
+		t.Errorf("Expired PIN not shown as invalid PIN: %q", written)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	testfe := testfrontend.NewTestFrontend()
+	fe := frontend.OpenFrontendish(testfe)
+
+	pins := loadPins(t, `[
+	{"handle": "guest", "pin": "111111", "role": "guest"},
+	{"handle": "member", "pin": "222222"},
+	{"handle": "keyholder", "pin": "333333", "role": "keyholder"}
+	]`)
+
+	// Opening hours which never include now.
+	hour := time.Duration(time.Now().Hour()) * time.Hour
+	policy := Policy{
+		Role:      "outside",
+		OpenHours: []pinstore.Window{{From: (hour + 2*time.Hour) % (24 * time.Hour), Until: (hour + 3*time.Hour) % (24 * time.Hour)}},
+	}
+
+	hometec := make(chan string)
+	go ValidatePins(pins, []Keypad{{fe, policy}}, hometec)
+
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"666", ""},
+		{"*111111", ""},
+		{"111111", ""},
+		{"222222", ""},
+		{"*222222", "close"},
+		{"333333", "open"},
+		{"**333333", ""},
+	} {
+		// Invalid PINs make the frontend ignore keypresses for 2s.
+		fe.IgnoreKeypresses(0)
+		cmd, _ := resultWithBuffer(testfe, constructPinBuffer(test.input), hometec)
+		if cmd != test.expected {
+			t.Errorf("Input %s: expected %q, got %q", test.input, test.expected, cmd)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The HTTP client for syncing PINs and reporting usage. Instead of putting
+// the BenutzerDB credentials into the URL (where they show up in ps), they
+// are read from a file, and the connection can be secured by a client
+// certificate (mutual TLS) and a pinned CA or server certificate.
+//
+// All of these only apply to https requests to the host of ServerURL (the
+// BenutzerDB): other hosts (redirect targets, e.g. a usage URL or secondary
+// PIN source on another host) are verified with the system CAs and get
+// neither the credentials nor the client certificate.
+package pinstore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ClientConfig struct {
+	// PEM files of the client certificate and its key. Both or none must
+	// be given.
+	CertFile string
+	KeyFile  string
+	// PEM file with the CA certificates which the server certificate must
+	// be signed by, instead of the system CAs.
+	CAFile string
+	// The SHA-256 fingerprint (hex, colons optional) of the server
+	// certificate. If set, only this certificate is accepted; without
+	// CAFile, it may be self-signed.
+	Fingerprint string
+	// File with "user:password" for HTTP basic authentication.
+	CredentialsFile string
+	// The https URL of the server which the settings above apply to.
+	// Required if any of them is given.
+	ServerURL string
+	// The timeout of a whole request, 0 means no timeout.
+	Timeout time.Duration
+}
+
+// Sends https requests to host via server (with basic authentication, if
+// user is set) and all other requests via other. The RoundTripper is called
+// for every redirect, too.
+type serverTransport struct {
+	host     string
+	user     string
+	password string
+	server   http.RoundTripper
+	other    http.RoundTripper
+}
+
+func (s *serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || !strings.EqualFold(req.URL.Host, s.host) {
+		return s.other.RoundTrip(req)
+	}
+	if s.user != "" {
+		// RoundTrippers must not modify the request.
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return s.server.RoundTrip(req)
+}
+
+// Reads "user:password" from filename.
+func loadCredentials(filename string) (user string, password string, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", "", err
+	}
+	credentials := strings.TrimSpace(string(contents))
+	idx := strings.Index(credentials, ":")
+	if idx < 1 || strings.Contains(credentials, "\n") {
+		return "", "", fmt.Errorf("%s: expected user:password", filename)
+	}
+	return credentials[:idx], credentials[idx+1:], nil
+}
+
+// Returns a function for tls.Config.VerifyPeerCertificate which only accepts
+// the server certificate with the given SHA-256 fingerprint.
+func verifyFingerprint(fingerprint string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	expected, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil || len(expected) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %q (expected %d hex encoded bytes)", fingerprint, sha256.Size)
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if string(sum[:]) != string(expected) {
+			return fmt.Errorf("server certificate has fingerprint %x, expected %x", sum, expected)
+		}
+		return nil
+	}, nil
+}
+
+// NewClient returns an HTTP client with the given configuration, which can be
+// used as Pinstore.Client.
+func NewClient(config ClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CAFile != "" {
+		contents, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("%s: no PEM encoded certificates found", config.CAFile)
+		}
+	}
+
+	if config.Fingerprint != "" {
+		verify, err := verifyFingerprint(config.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = verify
+		// The fingerprint replaces the verification of the chain (but
+		// not the verification of the CAFile).
+		tlsConfig.InsecureSkipVerify = config.CAFile == ""
+	}
+
+	client := &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		Timeout:   config.Timeout,
+	}
+	if config.CertFile == "" && config.CAFile == "" && config.Fingerprint == "" && config.CredentialsFile == "" {
+		return client, nil
+	}
+
+	u, err := url.Parse(config.ServerURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("the certificates and credentials only apply to an https server URL, %q is not one", config.ServerURL)
+	}
+	server := http.DefaultTransport.(*http.Transport).Clone()
+	server.TLSClientConfig = tlsConfig
+	transport := &serverTransport{host: u.Host, server: server, other: client.Transport}
+	if config.CredentialsFile != "" {
+		if transport.user, transport.password, err = loadCredentials(config.CredentialsFile); err != nil {
+			return nil, err
+		}
+	}
+	client.Transport = transport
+	return client, nil
+}
+
+// Returns the HTTP client to use.
+func (ps *Pinstore) client() *http.Client {
+	if ps.Client != nil {
+		return ps.Client
+	}
+	return http.DefaultClient
+}
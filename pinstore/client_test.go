@@ -0,0 +1,267 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the HTTP client configuration.
+package pinstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a self-signed certificate for template and its key.
+func selfSigned(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// Writes a self-signed client certificate and its key to dir.
+func writeClientCert(t *testing.T, dir string) (certFile string, keyFile string, cert *x509.Certificate) {
+	cert, key := selfSigned(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "pinpad"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	der := cert.Raw
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = path.Join(dir, "client.crt")
+	keyFile = path.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestClient(t *testing.T) {
+	filename := tempPins(t, map[string]string{"credentials": "pinpad:secret\n"})
+	dir := path.Dir(filename)
+	certFile, keyFile, clientCert := writeClientCert(t, dir)
+	credentials := path.Join(dir, "credentials")
+
+	delay := time.Duration(0)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if user, password, ok := r.BasicAuth(); !ok || user != "pinpad" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `[{"handle":"secure", "pin":"590023"}]`)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := path.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	full := ClientConfig{
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		CAFile:          caFile,
+		CredentialsFile: credentials,
+		ServerURL:       server.URL,
+		Timeout:         time.Second,
+	}
+	withoutCert := full
+	withoutCert.CertFile, withoutCert.KeyFile = "", ""
+	withoutCA := full
+	withoutCA.CAFile = ""
+	withoutCredentials := full
+	withoutCredentials.CredentialsFile = ""
+	pinned := withoutCA
+	pinned.Fingerprint = fingerprint
+	pinnedWithCA := full
+	pinnedWithCA.Fingerprint = fingerprint
+	wrongFingerprint := withoutCA
+	wrongFingerprint.Fingerprint = "00" + fingerprint[2:]
+
+	for _, test := range []struct {
+		name   string
+		config ClientConfig
+		ok     bool
+	}{
+		{"full", full, true},
+		{"without client certificate", withoutCert, false},
+		{"without CA", withoutCA, false},
+		{"without credentials", withoutCredentials, false},
+		{"pinned fingerprint", pinned, true},
+		{"pinned fingerprint and CA", pinnedWithCA, true},
+		{"wrong fingerprint", wrongFingerprint, false},
+	} {
+		client, err := NewClient(test.config)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		store, err := Load(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Client = client
+		err = store.Update(server.URL)
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: Update did not fail", test.name)
+		}
+		os.Remove(filename)
+		os.Remove(filename + ".sync")
+	}
+
+	client, err := NewClient(ClientConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerURL: server.URL, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay = 200 * time.Millisecond
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("Request did not time out")
+	}
+}
+
+func TestClientConfigErrors(t *testing.T) {
+	dir := path.Dir(tempPins(t, map[string]string{
+		"credentials": "no password",
+		"valid":       "pinpad:secret",
+		"ca.pem":      "foo",
+	}))
+	credentials := path.Join(dir, "credentials")
+	valid := path.Join(dir, "valid")
+	notPEM := path.Join(dir, "ca.pem")
+
+	for _, config := range []ClientConfig{
+		{CredentialsFile: credentials, ServerURL: "https://example.com/"},
+		{CredentialsFile: valid},
+		{CredentialsFile: valid, ServerURL: "http://example.com/pins"},
+		{Fingerprint: strings.Repeat("00", sha256.Size)},
+		{CredentialsFile: path.Join(dir, "nonexistent")},
+		{CAFile: notPEM},
+		{CertFile: notPEM, KeyFile: notPEM},
+		{Fingerprint: "ab:cd"},
+	} {
+		if _, err := NewClient(config); err == nil {
+			t.Errorf("NewClient(%+v) did not fail", config)
+		}
+	}
+}
+
+func TestClientServerScope(t *testing.T) {
+	filename := tempPins(t, map[string]string{"credentials": "pinpad:secret\n"})
+	dir := path.Dir(filename)
+	credentials := path.Join(dir, "credentials")
+	certFile, keyFile, _ := writeClientCert(t, dir)
+
+	// The other host has a certificate of its own, which the pinned
+	// fingerprint does not match, and asks for client certificates.
+	var leaked []string
+	otherCert, otherKey := selfSigned(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "other"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			leaked = append(leaked, "credentials to "+r.URL.Path)
+		}
+		if len(r.TLS.PeerCertificates) != 0 {
+			leaked = append(leaked, "client certificate to "+r.URL.Path)
+		}
+		io.WriteString(w, `[{"handle":"secure", "pin":"590023"}]`)
+	}))
+	other.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{otherCert.Raw}, PrivateKey: otherKey}},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	other.StartTLS()
+	defer other.Close()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, other.URL+"/redirected", http.StatusFound)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	client, err := NewClient(ClientConfig{
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		Fingerprint:     hex.EncodeToString(sum[:]),
+		CredentialsFile: credentials,
+		ServerURL:       server.URL + "/pins",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for the system CAs, which would verify a real host.
+	roots := x509.NewCertPool()
+	roots.AddCert(otherCert)
+	client.Transport.(*serverTransport).other.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	store, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Client = client
+
+	// The redirect to the other host is followed without credentials,
+	// client certificate or pinning.
+	if err := store.Update(server.URL + "/pins"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup("590023"); !ok {
+		t.Error("PIN from the redirect target not found")
+	}
+	// The same goes for other URLs, e.g. the usage URL.
+	resp, err := client.Get(other.URL + "/usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(leaked) != 0 {
+		t.Errorf("Sent %v", leaked)
+	}
+}
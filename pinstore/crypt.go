@@ -0,0 +1,185 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The PINs (and the usage counters, which contain PINs, too) are stored on
+// the SD card. With a key (see LoadEncrypted), these files are encrypted with
+// AES-256-GCM, so that a lost or copied SD card does not leak PINs. The key
+// should be kept outside of the data partition in a file only readable by
+// root:
+//
+//	head -c 32 /dev/urandom | base64 > /etc/pinpad/cache.key
+//	chmod 600 /etc/pinpad/cache.key
+//
+// Encrypted files start with encryptedMagic, followed by the nonce and the
+// sealed contents. The name of the file is authenticated as well, so that
+// e.g. a quarantined update cannot be passed off as the effective PINs.
+// Existing plain text files (PINs, usage counters and updates in quarantine)
+// are still read and encrypted on Load.
+//
+// All files are written atomically: to a temporary file, which is synced
+// and renamed, followed by a sync of the directory.
+package pinstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const CACHE_KEY_SIZE = 32
+
+var encryptedMagic = []byte("pinpad-aes-gcm-1\n")
+
+var (
+	ErrNoKey   = errors.New("file is encrypted, but no key is configured")
+	ErrDecrypt = errors.New("could not decrypt (wrong key or modified file)")
+)
+
+// LoadCacheKey reads a base64 encoded AES-256 key from filename, which must
+// not be accessible by anyone but its owner.
+func LoadCacheKey(filename string) ([]byte, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: must only be accessible by its owner (chmod 600)", filename)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(key) != CACHE_KEY_SIZE {
+		return nil, fmt.Errorf("%s: expected %d bytes, got %d", filename, CACHE_KEY_SIZE, len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the contents of the file filename.
+func seal(key []byte, filename string, contents []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	result := append(append([]byte{}, encryptedMagic...), nonce...)
+	return gcm.Seal(result, nonce, contents, []byte(path.Base(filename))), nil
+}
+
+// Decrypts the contents of the file filename.
+func unseal(key []byte, filename string, contents []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrNoKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	contents = contents[len(encryptedMagic):]
+	if len(contents) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := contents[:gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, contents[gcm.NonceSize():], []byte(path.Base(filename)))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// Reads filename and decrypts it if it is encrypted. Plain text files are
+// returned as is.
+func readCache(key []byte, filename string) (contents []byte, encrypted bool, err error) {
+	contents, err = ioutil.ReadFile(filename)
+	if err != nil || !bytes.HasPrefix(contents, encryptedMagic) {
+		return contents, false, err
+	}
+	if contents, err = unseal(key, filename, contents); err != nil {
+		return nil, true, fmt.Errorf("%s: %s", filename, err)
+	}
+	return contents, true, nil
+}
+
+// Encrypts filename if it exists and is not encrypted yet.
+func encryptLeftover(key []byte, filename string) error {
+	contents, encrypted, err := readCache(key, filename)
+	if os.IsNotExist(err) || encrypted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeCache(key, filename, contents); err != nil {
+		return err
+	}
+	fmt.Printf("pinstore: encrypted %s\n", filename)
+	return nil
+}
+
+// Writes contents to filename, encrypted if key is not nil.
+func writeCache(key []byte, filename string, contents []byte) error {
+	if key != nil {
+		var err error
+		if contents, err = seal(key, filename, contents); err != nil {
+			return err
+		}
+	}
+	return writeAtomic(filename, contents)
+}
+
+// Replaces filename with contents, so that either the old or the new
+// contents survive a power failure.
+func writeAtomic(filename string, contents []byte) error {
+	dir := path.Dir(filename)
+	file, err := ioutil.TempFile(dir, path.Base(filename)+".new")
+	if err != nil {
+		return fmt.Errorf("could not get tmpfile: %s", err)
+	}
+	_, err = file.Write(contents)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("could not write %s: %s", filename, err)
+	}
+
+	// Make the rename durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %s", dir, err)
+	}
+	return nil
+}
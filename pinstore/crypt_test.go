@@ -0,0 +1,179 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the encrypted cache and the in-memory mode.
+package pinstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedCache(t *testing.T) {
+	filename := tempPins(t, nil)
+	key := bytes.Repeat([]byte{42}, CACHE_KEY_SIZE)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"handle":"secure", "pin":"590023"}, {"handle":"delivery", "pin":"123456", "max_uses": 2}]`)
+	}))
+	defer server.Close()
+
+	store, err := LoadEncrypted(filename, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filename, filename + ".uses"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(contents, encryptedMagic) || bytes.Contains(contents, []byte("123456")) {
+			t.Errorf("%s is not encrypted: %q", name, contents)
+		}
+	}
+
+	store, err = LoadEncrypted(filename, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := store.Lookup("590023"); !ok || entry.Handle != "secure" {
+		t.Error(`Pin for "secure" not found after LoadEncrypted`)
+	}
+	if uses := store.Uses("123456"); uses != 1 {
+		t.Errorf("Expected 1 use after LoadEncrypted, got %d", uses)
+	}
+
+	if _, err := Load(filename); err == nil || !strings.Contains(err.Error(), ErrNoKey.Error()) {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+	if _, err := LoadEncrypted(filename, bytes.Repeat([]byte{23}, CACHE_KEY_SIZE)); err == nil {
+		t.Error("LoadEncrypted succeeded with the wrong key")
+	}
+
+	// The file name is authenticated.
+	renamed := path.Join(path.Dir(filename), "other.json")
+	os.Rename(filename, renamed)
+	if _, err := LoadEncrypted(renamed, key); err == nil || !strings.Contains(err.Error(), ErrDecrypt.Error()) {
+		t.Errorf("Expected ErrDecrypt for a renamed file, got %v", err)
+	}
+	contents, _ := ioutil.ReadFile(renamed)
+	contents[len(contents)-1] ^= 1
+	if err := ioutil.WriteFile(filename, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadEncrypted(filename, key); err == nil || !strings.Contains(err.Error(), ErrDecrypt.Error()) {
+		t.Errorf("Expected ErrDecrypt for a modified file, got %v", err)
+	}
+}
+
+func TestEncryptPlainCache(t *testing.T) {
+	filename := tempPins(t, map[string]string{
+		"pins.json":            `[{"handle":"secure", "pin":"590023"}, {"handle":"delivery", "pin":"123456", "max_uses": 1}]`,
+		"pins.json.uses":       `{"delivery:123456": {"handle": "delivery", "pin": "123456", "uses": 1}}`,
+		"pins.json.quarantine": `[{"handle":"x", "pin":"666666"}]`,
+	})
+	key := bytes.Repeat([]byte{42}, CACHE_KEY_SIZE)
+
+	store, err := LoadEncrypted(filename, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup("590023"); !ok {
+		t.Error(`Pin for "secure" not found`)
+	}
+	if uses := store.Uses("123456"); uses != 1 {
+		t.Errorf("Expected 1 use, got %d", uses)
+	}
+	for _, name := range []string{filename, filename + ".uses", filename + ".quarantine"} {
+		if contents, _ := ioutil.ReadFile(name); !bytes.HasPrefix(contents, encryptedMagic) {
+			t.Errorf("Plain text file %s was not encrypted: %q", name, contents)
+		}
+	}
+}
+
+func TestUnreadableUsage(t *testing.T) {
+	filename := tempPins(t, map[string]string{"pins.json": `[{"handle":"delivery", "pin":"123456", "max_uses": 1}]`})
+	key := bytes.Repeat([]byte{42}, CACHE_KEY_SIZE)
+	if err := writeCache(key, filename+".uses", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the counters, used up PINs would be usable again.
+	if _, err := Load(filename); err == nil || !strings.Contains(err.Error(), ErrNoKey.Error()) {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+	if err := ioutil.WriteFile(filename+".uses", []byte(`{"delivery:123456": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil {
+		t.Error("Load succeeded with broken usage counters")
+	}
+}
+
+func TestLoadCacheKey(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{42}, CACHE_KEY_SIZE)) + "\n"
+	filename := path.Join(path.Dir(tempPins(t, map[string]string{"cache.key": encoded})), "cache.key")
+
+	os.Chmod(filename, 0644)
+	if _, err := LoadCacheKey(filename); err == nil {
+		t.Error("LoadCacheKey accepted a world-readable key file")
+	}
+
+	os.Chmod(filename, 0600)
+	if key, err := LoadCacheKey(filename); err != nil || len(key) != CACHE_KEY_SIZE {
+		t.Errorf("LoadCacheKey failed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCacheKey(filename); err == nil {
+		t.Error("LoadCacheKey accepted a short key")
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	dir := path.Dir(tempPins(t, nil))
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, `[{"handle":"delivery", "pin":"123456", "max_uses": 1}]`)
+	}))
+	defer server.Close()
+
+	store, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", time.Now()); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("In-memory Pinstore wrote %d files, e.g. %s", len(files), files[0].Name())
+	}
+}
@@ -0,0 +1,152 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Change reporting and delta syncs.
+//
+// Whenever a PIN list becomes effective, the handles which were added,
+// removed or changed are published as a pins.changed event (and thereby
+// written to the audit log). Only handles and the names of changed fields
+// are published, never PINs or secrets.
+//
+// With Delta set, Update asks the server for a delta (RFC 3229) by sending
+// "A-IM: pin-delta" along with the ETag of the current PINs. A server which
+// supports it answers with "226 IM Used", "IM: pin-delta" and a JSON body
+// like
+//
+//	{"upsert": [{"handle": "alice", "pin": "123456"}],
+//	 "remove": ["bob"]}
+//
+// which is applied to the current PINs by handle. Servers which do not
+// support deltas just send the full list. Deltas are signed like full lists.
+// With a public key, deltas are not requested: the resulting list has no
+// signature, so it could not be verified when it is loaded again.
+package pinstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	DELTA_IM = "pin-delta"
+	// The status code of delta responses (RFC 3229).
+	STATUS_IM_USED = 226
+)
+
+type Diff struct {
+	Added   []string
+	Removed []string
+	// The handles of changed entries, with the names of the changed fields.
+	Changed map[string][]string
+}
+
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *Diff) String() string {
+	var changed []string
+	for handle, fields := range d.Changed {
+		changed = append(changed, fmt.Sprintf("%s: %s", handle, strings.Join(fields, ", ")))
+	}
+	sort.Strings(changed)
+	return fmt.Sprintf("%d added (%s), %d removed (%s), %d changed (%s)",
+		len(d.Added), strings.Join(d.Added, ", "),
+		len(d.Removed), strings.Join(d.Removed, ", "),
+		len(changed), strings.Join(changed, "; "))
+}
+
+// Returns the names (like in JSON) of the fields which differ. Handle,
+// Source and Generation are not compared.
+func changedFields(old *Entry, new *Entry) []string {
+	var fields []string
+	for _, field := range []struct {
+		name string
+		old  interface{}
+		new  interface{}
+	}{
+		{"pin", old.Pin, new.Pin},
+		{"id", old.ID, new.ID},
+		{"totp", old.TOTP, new.TOTP},
+		{"duress_pin", old.DuressPin, new.DuressPin},
+		{"role", old.Role, new.Role},
+		{"valid_from", old.ValidFrom, new.ValidFrom},
+		{"valid_until", old.ValidUntil, new.ValidUntil},
+		{"schedule", old.Schedule, new.Schedule},
+		{"max_uses", old.MaxUses, new.MaxUses},
+	} {
+		if !reflect.DeepEqual(field.old, field.new) {
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+// Returns the name of an entry in diffs and events.
+func handleOf(entry *Entry) string {
+	if entry.Handle == "" {
+		return "(no handle)"
+	}
+	return entry.Handle
+}
+
+func byHandle(entries []Entry) map[string]*Entry {
+	result := make(map[string]*Entry, len(entries))
+	for idx := range entries {
+		result[handleOf(&entries[idx])] = &entries[idx]
+	}
+	return result
+}
+
+// Compares the entries by handle.
+func diff(old []Entry, new []Entry) *Diff {
+	d := &Diff{Changed: make(map[string][]string)}
+	oldEntries := byHandle(old)
+	newEntries := byHandle(new)
+	for handle, entry := range newEntries {
+		oldEntry, ok := oldEntries[handle]
+		if !ok {
+			d.Added = append(d.Added, handle)
+		} else if fields := changedFields(oldEntry, entry); len(fields) > 0 {
+			d.Changed[handle] = fields
+		}
+	}
+	for handle := range oldEntries {
+		if _, ok := newEntries[handle]; !ok {
+			d.Removed = append(d.Removed, handle)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+type delta struct {
+	Upsert []Entry  `json:"upsert"`
+	Remove []string `json:"remove"`
+}
+
+// Applies the delta in body to the entries and returns the resulting PIN
+// list as JSON.
+func applyDelta(entries []Entry, body []byte) ([]byte, error) {
+	var d delta
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("invalid delta: %s", jsonError(body, err))
+	}
+	drop := make(map[string]bool)
+	for _, handle := range d.Remove {
+		drop[handle] = true
+	}
+	for idx := range d.Upsert {
+		drop[handleOf(&d.Upsert[idx])] = true
+	}
+	result := []Entry{}
+	for idx := range entries {
+		if !drop[handleOf(&entries[idx])] {
+			result = append(result, entries[idx])
+		}
+	}
+	return json.Marshal(append(result, d.Upsert...))
+}
@@ -0,0 +1,118 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for change reporting and delta syncs.
+package pinstore
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"pinpad-controller/events"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old, _ := decode([]byte(`[
+	{"handle": "alice", "pin": "111111"},
+	{"handle": "bob", "pin": "222222"},
+	{"handle": "carol", "pin": "333333", "role": "guest"}
+	]`), FORMAT_JSON)
+	new, _ := decode([]byte(`[
+	{"handle": "alice", "pin": "111111"},
+	{"handle": "carol", "pin": "444444", "role": "admin"},
+	{"handle": "dave", "pin": "555555"}
+	]`), FORMAT_JSON)
+
+	d := diff(old, new)
+	if !reflect.DeepEqual(d.Added, []string{"dave"}) || !reflect.DeepEqual(d.Removed, []string{"bob"}) ||
+		!reflect.DeepEqual(d.Changed, map[string][]string{"carol": {"pin", "role"}}) {
+		t.Errorf("Unexpected diff %+v", d)
+	}
+	if s := d.String(); s != "1 added (dave), 1 removed (bob), 1 changed (carol: pin, role)" {
+		t.Errorf("Unexpected string %q", s)
+	}
+	if d := diff(old, old); !d.Empty() {
+		t.Errorf("Expected empty diff, got %s", d)
+	}
+}
+
+func TestDeltaSync(t *testing.T) {
+	filename := tempPins(t, nil)
+
+	var deltaRequested bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deltaRequested = r.Header.Get("A-IM") == DELTA_IM
+		if deltaRequested && r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("ETag", `"v2"`)
+			w.Header().Set("IM", DELTA_IM)
+			w.WriteHeader(STATUS_IM_USED)
+			io.WriteString(w, `{"upsert": [{"handle": "bob", "pin": "333333"}, {"handle": "carol", "pin": "444444"}], "remove": ["alice"]}`)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, `[{"handle": "alice", "pin": "111111"}, {"handle": "bob", "pin": "222222"}]`)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Delta = true
+	var changes []int
+	store.OnChange = func(source string, generation uint64, d *Diff) {
+		changes = append(changes, len(d.Added), len(d.Removed), len(d.Changed))
+	}
+
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if deltaRequested {
+		t.Error("Delta requested without ETag")
+	}
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if !deltaRequested {
+		t.Error("No delta requested")
+	}
+	for pin, handle := range map[string]string{"333333": "bob", "444444": "carol"} {
+		if entry, ok := store.Lookup(pin); !ok || entry.Handle != handle {
+			t.Errorf("PIN of %s not found after delta", handle)
+		}
+	}
+	if _, ok := store.Lookup("111111"); ok {
+		t.Error("PIN of alice not removed by delta")
+	}
+	if !reflect.DeepEqual(changes, []int{2, 0, 0, 1, 1, 1}) {
+		t.Errorf("Unexpected changes %v", changes)
+	}
+
+	var changed *events.Event
+	for len(ch) > 0 {
+		if event := <-ch; event.Type == "pins.changed" {
+			changed = &event
+		}
+	}
+	if changed == nil || changed.Message != "primary PINs (generation 3): 1 added (carol), 1 removed (alice), 1 changed (bob: pin)" {
+		t.Errorf("Unexpected event %v", changed)
+	}
+
+	// The result of the delta is stored as a full list.
+	store, err = Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Snapshot().Len() != 2 || store.primary.current.validators.ETag != `"v2"` {
+		t.Errorf("Unexpected PINs after Load: %s", store.Status())
+	}
+	if contents, _ := ioutil.ReadFile(filename); !strings.Contains(string(contents), "444444") {
+		t.Errorf("Unexpected file contents %s", contents)
+	}
+}
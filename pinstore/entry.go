@@ -0,0 +1,189 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Entries of the PIN list. Besides handle and PIN, an entry can restrict when
+// the PIN is valid, e.g. for guests of a workshop:
+//
+//	{"handle": "guest", "pin": "123456",
+//	 "valid_from": "2013-01-05T00:00:00+01:00",
+//	 "valid_until": "2013-01-07T00:00:00+01:00",
+//	 "schedule": [{"days": ["sat", "sun"], "from": "10:00", "until": "18:00"}],
+//	 "max_uses": 1}
+//
+// The restrictions are checked against the local clock, so they also work
+// while the sync is down.
+package pinstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Entry struct {
+	Handle string
+	// Empty for members who only use TOTP.
+	Pin string
+	// The member id and base32 encoded TOTP secret (see totp.go).
+	ID   string `json:"id,omitempty"`
+	TOTP string `json:"totp,omitempty"`
+	// An alternative PIN which opens the door like Pin, but raises a silent
+	// alarm.
+	DuressPin string `json:"duress_pin,omitempty"`
+	// One of Roles, empty means DEFAULT_ROLE (see roles.go).
+	Role string `json:"role,omitempty"`
+	// The source the entry is from (see sources.go).
+	Source string `json:"-"`
+	// The generation of the snapshot the entry is from (see snapshot.go).
+	Generation uint64 `json:"-"`
+	// If set, the PIN is not valid before ValidFrom.
+	ValidFrom *time.Time `json:"valid_from,omitempty"`
+	// If set, the PIN is not valid from ValidUntil on.
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// If not empty, the PIN is only valid within one of the windows.
+	Schedule []Window `json:"schedule,omitempty"`
+	// If not 0, the PIN can only be used this many times (see usage.go).
+	MaxUses int `json:"max_uses,omitempty"`
+}
+
+// Window is a weekly recurring time span in local time. Until may be before
+// From, in which case the window spans midnight (and belongs to the day it
+// starts on).
+type Window struct {
+	// Empty means every day.
+	Days  []time.Weekday
+	From  time.Duration
+	Until time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parses a time of day like "18:30" into the offset since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid time of day %q (expected e.g. 18:30)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+func (w *Window) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Days  []string
+		From  string
+		Until string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	w.Days = nil
+	for _, day := range raw.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid day %q (expected mon, tue, …)", day)
+		}
+		w.Days = append(w.Days, weekday)
+	}
+	if raw.From == "" {
+		raw.From = "00:00"
+	}
+	if raw.Until == "" {
+		raw.Until = "24:00"
+	}
+	var err error
+	if w.From, err = parseTimeOfDay(raw.From); err != nil {
+		return err
+	}
+	if w.Until, err = parseTimeOfDay(raw.Until); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w Window) MarshalJSON() ([]byte, error) {
+	var raw struct {
+		Days  []string `json:"days,omitempty"`
+		From  string   `json:"from"`
+		Until string   `json:"until"`
+	}
+	for _, day := range w.Days {
+		raw.Days = append(raw.Days, strings.ToLower(day.String()[:3]))
+	}
+	raw.From = formatTimeOfDay(w.From)
+	raw.Until = formatTimeOfDay(w.Until)
+	return json.Marshal(raw)
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns whether t (in local time) is within the window.
+func (w Window) Contains(t time.Time) bool {
+	t = t.Local()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.From <= w.Until {
+		return w.onDay(t.Weekday()) && offset >= w.From && offset < w.Until
+	}
+	// The window spans midnight: either it started today or yesterday.
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.onDay(t.Weekday()) && offset >= w.From) ||
+		(w.onDay(yesterday) && offset < w.Until)
+}
+
+// ValidAt returns whether the PIN may be used at t.
+func (e *Entry) ValidAt(t time.Time) bool {
+	if e.ValidFrom != nil && t.Before(*e.ValidFrom) {
+		return false
+	}
+	if e.ValidUntil != nil && !t.Before(*e.ValidUntil) {
+		return false
+	}
+	return InWindows(e.Schedule, t)
+}
+
+// Returns whether the entry can be used at all: it needs a known role and a
+// numeric PIN or a numeric member id and a valid TOTP secret.
+func (e *Entry) wellFormed() bool {
+	if _, ok := Roles[e.role()]; e.Handle == "" || !ok {
+		return false
+	}
+	if e.TOTP != "" {
+		if _, err := decodeSecret(e.TOTP); err != nil || !validPin(e.ID) {
+			return false
+		}
+	}
+	if e.DuressPin != "" && (!validPin(e.DuressPin) || e.DuressPin == e.Pin) {
+		return false
+	}
+	return (e.Pin == "" && e.TOTP != "") || validPin(e.Pin)
+}
+
+// Expired returns whether the PIN will never be valid again after t.
+func (e *Entry) Expired(t time.Time) bool {
+	return e.ValidUntil != nil && !t.Before(*e.ValidUntil)
+}
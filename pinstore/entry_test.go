@@ -0,0 +1,92 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the validity of entries.
+package pinstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEntryValidAt(t *testing.T) {
+	var entries []Entry
+	err := json.Unmarshal([]byte(`[
+	{"handle": "guest", "pin": "123456",
+	 "valid_from": "2013-01-05T00:00:00Z",
+	 "valid_until": "2013-01-07T00:00:00Z"},
+	{"handle": "weekend", "pin": "234567",
+	 "schedule": [{"days": ["sat", "sun"], "from": "10:00", "until": "18:00"}]},
+	{"handle": "night", "pin": "345678",
+	 "schedule": [{"days": ["Fri"], "from": "22:00", "until": "02:00"}]}
+	]`), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2013-01-05 is a saturday.
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	utc := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		return t
+	}
+
+	for _, test := range []struct {
+		entry int
+		t     time.Time
+		valid bool
+	}{
+		{0, utc("2013-01-04 23:59"), false},
+		{0, utc("2013-01-05 00:00"), true},
+		{0, utc("2013-01-06 23:59"), true},
+		{0, utc("2013-01-07 00:00"), false},
+		{1, at("2013-01-05 09:59"), false},
+		{1, at("2013-01-05 10:00"), true},
+		{1, at("2013-01-06 17:59"), true},
+		{1, at("2013-01-06 18:00"), false},
+		{1, at("2013-01-07 12:00"), false},
+		{2, at("2013-01-04 21:59"), false},
+		{2, at("2013-01-04 23:00"), true},
+		{2, at("2013-01-05 01:59"), true},
+		{2, at("2013-01-05 02:00"), false},
+		{2, at("2013-01-05 23:00"), false},
+	} {
+		if valid := entries[test.entry].ValidAt(test.t); valid != test.valid {
+			t.Errorf("%s at %s: expected %v, got %v", entries[test.entry].Handle, test.t, test.valid, valid)
+		}
+	}
+
+	if !entries[0].Expired(utc("2013-01-07 00:00")) || entries[1].Expired(utc("2013-01-07 00:00")) {
+		t.Error("Expired returned the wrong result")
+	}
+}
+
+func TestWindowJSON(t *testing.T) {
+	var w Window
+	if err := json.Unmarshal([]byte(`{"days": ["mon"], "from": "8:00"}`), &w); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"days":["mon"],"from":"08:00","until":"24:00"}` {
+		t.Errorf("Unexpected encoding %s", encoded)
+	}
+
+	for _, invalid := range []string{
+		`{"days": ["monday"]}`,
+		`{"from": "25:00"}`,
+		`{"until": "noon"}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &w); err == nil {
+			t.Errorf("No error for %s", invalid)
+		}
+	}
+}
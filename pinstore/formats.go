@@ -0,0 +1,301 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Besides the JSON array, PIN lists can be CSV or YAML files, which are
+// easier to edit by hand (e.g. the emergency file). The format is detected by
+// the Content-Type of the HTTP response or the file extension. Synced lists
+// are stored as they were received, so the format of the stored file is
+// detected by its contents (see formatByContent).
+//
+// CSV files need a header line naming the columns; lines starting with # are
+// comments:
+//
+//	handle,pin,role,schedule
+//	secure,590023,keyholder,
+//	guest,123456,guest,"sat,sun 10:00-18:00"
+//
+// YAML files are a list of mappings with scalar values (a small subset of
+// YAML):
+//
+//	# keyholders
+//	- handle: secure
+//	  pin: "590023"
+//	  role: keyholder
+//	- handle: guest
+//	  pin: "123456"
+//	  schedule: sat,sun 10:00-18:00
+//
+// In both formats, the fields are named like in JSON and schedules are given
+// like "mon,tue 18:00-23:00;sat 10:00-22:00" (see ParseWindows).
+package pinstore
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+	FORMAT_YAML = "yaml"
+)
+
+// Returns the format of filename (or the path of an URL) by its extension.
+func formatByExtension(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv":
+		return FORMAT_CSV
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	}
+	return FORMAT_JSON
+}
+
+// Returns the format of a PIN list by its first line which is neither empty
+// nor a comment: JSON starts with [, YAML with - (and an empty YAML list is
+// empty), anything else is taken for the header line of a CSV file.
+func formatByContent(contents []byte) string {
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		switch line[0] {
+		case '[':
+			return FORMAT_JSON
+		case '-':
+			return FORMAT_YAML
+		}
+		return FORMAT_CSV
+	}
+	return FORMAT_YAML
+}
+
+// Returns the format of an HTTP response by its Content-Type, or "" if the
+// Content-Type does not tell.
+func formatByContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/json":
+		return FORMAT_JSON
+	case "text/csv":
+		return FORMAT_CSV
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return FORMAT_YAML
+	}
+	return ""
+}
+
+// Decodes the PIN list in the given format.
+func decode(contents []byte, format string) ([]Entry, error) {
+	switch format {
+	case FORMAT_JSON, "":
+		var entries []Entry
+		if err := json.Unmarshal(contents, &entries); err != nil {
+			return nil, jsonError(contents, err)
+		}
+		return entries, nil
+	case FORMAT_CSV:
+		return decodeCSV(contents)
+	case FORMAT_YAML:
+		return decodeYAML(contents)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// Adds the line number to errors of encoding/json, which only know the byte
+// offset.
+func jsonError(contents []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	return fmt.Errorf("line %d: %s", bytes.Count(contents[:offset], []byte("\n"))+1, err)
+}
+
+// The fields which can be set with setField.
+var fieldNames = map[string]bool{
+	"handle": true, "pin": true, "id": true, "totp": true, "duress_pin": true,
+	"role": true, "valid_from": true, "valid_until": true, "max_uses": true,
+	"schedule": true,
+}
+
+// Sets the field key of entry (named like in JSON) from its textual value.
+func setField(entry *Entry, key string, value string) error {
+	var err error
+	switch key {
+	case "handle":
+		entry.Handle = value
+	case "pin":
+		entry.Pin = value
+	case "id":
+		entry.ID = value
+	case "totp":
+		entry.TOTP = value
+	case "duress_pin":
+		entry.DuressPin = value
+	case "role":
+		entry.Role = value
+	case "valid_from", "valid_until":
+		if value == "" {
+			return nil
+		}
+		t, e := time.Parse(time.RFC3339, value)
+		if e != nil {
+			return fmt.Errorf("%s: expected a time like 2013-01-05T00:00:00+01:00, got %q", key, value)
+		}
+		if key == "valid_from" {
+			entry.ValidFrom = &t
+		} else {
+			entry.ValidUntil = &t
+		}
+	case "max_uses":
+		if value == "" {
+			return nil
+		}
+		if entry.MaxUses, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("max_uses: expected a number, got %q", value)
+		}
+	case "schedule":
+		if entry.Schedule, err = ParseWindows(value); err != nil {
+			return fmt.Errorf("schedule: %s", err)
+		}
+	default:
+		return fmt.Errorf("unknown field %q", key)
+	}
+	return nil
+}
+
+func decodeCSV(contents []byte) ([]Entry, error) {
+	reader := csv.NewReader(strings.NewReader(string(contents)))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("line 1: missing header line (e.g. handle,pin)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for idx := range header {
+		header[idx] = strings.ToLower(strings.TrimSpace(header[idx]))
+		if !fieldNames[header[idx]] {
+			line, _ := reader.FieldPos(idx)
+			return nil, fmt.Errorf("line %d: unknown field %q", line, header[idx])
+		}
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// csv.ParseError contains the line number.
+			return nil, err
+		}
+		var entry Entry
+		for idx, value := range record {
+			if err := setField(&entry, header[idx], strings.TrimSpace(value)); err != nil {
+				line, _ := reader.FieldPos(idx)
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Unquotes a YAML scalar.
+func yamlScalar(value string) (string, error) {
+	if strings.HasPrefix(value, `"`) {
+		return strconv.Unquote(value)
+	}
+	if strings.HasPrefix(value, "'") {
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	// Strip comments after plain scalars.
+	if idx := strings.Index(value, " #"); idx > -1 {
+		value = value[:idx]
+	}
+	return strings.TrimSpace(value), nil
+}
+
+func decodeYAML(contents []byte) ([]Entry, error) {
+	var entries []Entry
+	var entry *Entry
+	// The indentation of the keys of the current entry.
+	indent := -1
+	for idx, line := range strings.Split(string(contents), "\n") {
+		lineno := idx + 1
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineno)
+		}
+		if trimmed == "[]" && entry == nil {
+			continue
+		}
+
+		keyIndent := len(line) - len(trimmed)
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if keyIndent != 0 {
+				return nil, fmt.Errorf("line %d: nested lists are not supported", lineno)
+			}
+			entries = append(entries, Entry{})
+			entry = &entries[len(entries)-1]
+			trimmed = strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+			indent = len(line) - len(trimmed)
+			if trimmed == "" {
+				indent = -1
+				continue
+			}
+		} else if entry == nil {
+			return nil, fmt.Errorf("line %d: expected a list item (- handle: …)", lineno)
+		} else if indent == -1 {
+			indent = keyIndent
+		} else if keyIndent != indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation (nested values are not supported)", lineno)
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon == -1 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineno)
+		}
+		key := strings.TrimSpace(trimmed[:colon])
+		value, err := yamlScalar(strings.TrimSpace(trimmed[colon+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		if err := setField(entry, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+	}
+	return entries, nil
+}
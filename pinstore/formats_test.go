@@ -0,0 +1,141 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the CSV and YAML formats.
+package pinstore
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkEntries(t *testing.T, format string, entries []Entry) {
+	if len(entries) != 2 {
+		t.Fatalf("%s: expected 2 entries, got %d", format, len(entries))
+	}
+	if entries[0].Handle != "secure" || entries[0].Pin != "590023" || entries[0].Role != "keyholder" {
+		t.Errorf("%s: unexpected first entry %+v", format, entries[0])
+	}
+	guest := entries[1]
+	if guest.Handle != "guest" || guest.Pin != "123456" || guest.MaxUses != 3 ||
+		guest.ValidUntil == nil || !guest.ValidUntil.Equal(time.Date(2013, 1, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("%s: unexpected second entry %+v", format, guest)
+	}
+	if len(guest.Schedule) != 1 || len(guest.Schedule[0].Days) != 2 || guest.Schedule[0].From != 10*time.Hour {
+		t.Errorf("%s: unexpected schedule %+v", format, guest.Schedule)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	entries, err := decode([]byte(`# comment
+handle, pin, role, max_uses, valid_until, schedule
+secure,590023,keyholder,,,
+guest,123456,,3,2013-01-07T00:00:00Z,"sat,sun 10:00-18:00"
+`), FORMAT_CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, "csv", entries)
+
+	entries, err = decode([]byte(`---
+# keyholders
+- handle: secure
+  pin: "590023"
+  role: keyholder # comment
+-
+  handle: 'guest'
+  pin: 123456
+  max_uses: 3
+  valid_until: 2013-01-07T00:00:00Z
+  schedule: sat,sun 10:00-18:00
+`), FORMAT_YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, "yaml", entries)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		contents string
+		err      string
+	}{
+		{FORMAT_CSV, "handle,pin\nsecure,590023\nguest\n", "line 3"},
+		{FORMAT_CSV, "handle,pin,color\n", `line 1: unknown field "color"`},
+		{FORMAT_CSV, "handle,pin,max_uses\n\nsecure,590023,many\n", "line 3: max_uses"},
+		{FORMAT_CSV, "", "line 1: missing header"},
+		{FORMAT_YAML, "- handle: secure\n  pin: 590023\n   role: admin\n", "line 3: unexpected indentation"},
+		{FORMAT_YAML, "- handle: secure\n  schedule:\n  - days: sat\n", "line 3: nested lists"},
+		{FORMAT_YAML, "handle: secure\n", "line 1: expected a list item"},
+		{FORMAT_YAML, "- handle: secure\n\n  valid_from: tomorrow\n", "line 3: valid_from"},
+		{FORMAT_YAML, "- handle: \"secure\n", "line 1: "},
+		{FORMAT_JSON, "[\n{\"handle\": \"secure\",\n\"pin\": 590023}]", "line 3: "},
+		{FORMAT_JSON, "[\n{\"handle\": \"secure\"\n\"pin\": \"590023\"}]", "line 3: "},
+	} {
+		_, err := decode([]byte(test.contents), test.format)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s %q: expected error containing %q, got %v", test.format, test.contents, test.err, err)
+		}
+	}
+}
+
+func TestFormatDetection(t *testing.T) {
+	filename := tempPins(t, map[string]string{"emergency.yml": "- handle: keyholder\n  pin: 111111\n"})
+	emergency := path.Join(path.Dir(filename), "emergency.yml")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		io.WriteString(w, "handle,pin\nsecure,590023\n")
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadEmergency(emergency); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup("111111"); !ok {
+		t.Error("PIN from the YAML file not found")
+	}
+	if _, ok := store.Lookup("590023"); !ok {
+		t.Error("PIN from the CSV response not found")
+	}
+
+	// The CSV is stored as is, so Load needs to detect the format, even
+	// without the .sync file.
+	for i := 0; i < 2; i++ {
+		store, err = Load(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := store.Lookup("590023"); !ok {
+			t.Error("PIN from the CSV response not found after Load")
+		}
+		os.Remove(filename + ".sync")
+	}
+}
+
+func TestFormatByContent(t *testing.T) {
+	for contents, expected := range map[string]string{
+		"[]":                                     FORMAT_JSON,
+		"\n  [{\"handle\": \"secure\"}]":         FORMAT_JSON,
+		"# keyholders\n---\n- handle: secure\n":  FORMAT_YAML,
+		"# nobody\n":                             FORMAT_YAML,
+		"# comment\nhandle,pin\nsecure,590023\n": FORMAT_CSV,
+	} {
+		if format := formatByContent([]byte(contents)); format != expected {
+			t.Errorf("%q: expected %s, got %s", contents, expected, format)
+		}
+	}
+}
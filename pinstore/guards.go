@@ -0,0 +1,210 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Sanity checks for PIN updates. A mistake in the BenutzerDB (e.g. an empty
+// list) must not lock out every member, so suspicious updates are held in
+// quarantine: the old PINs stay active, the update is written to
+// <filename>.quarantine for inspection and an admin needs to confirm it (see
+// Confirm) before it becomes effective. Updates in quarantine do not count as
+// failed syncs (see scheduler.go).
+package pinstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"pinpad-controller/events"
+	"strings"
+)
+
+type Guards struct {
+	// Hold updates which remove more than this percentage of the current
+	// entries (static PINs and TOTP members alike). 0 disables the check.
+	MaxRemovedPercent int
+	// Hold updates with less PINs than this.
+	MinCount int
+	// Hold updates which contain a PIN or member id more than once.
+	RejectDuplicates bool
+	// Hold updates with entries that have no handle, an unknown role, a PIN
+	// which is not numeric or an invalid TOTP secret.
+	RejectMalformed bool
+}
+
+var DefaultGuards = Guards{
+	MaxRemovedPercent: 50,
+	MinCount:          1,
+	RejectDuplicates:  true,
+	RejectMalformed:   true,
+}
+
+var ErrNoQuarantine = errors.New("no PIN update in quarantine")
+
+// QuarantineError is returned by Update when the update was held.
+type QuarantineError struct {
+	Reasons []string
+}
+
+func (e *QuarantineError) Error() string {
+	return "PIN update held in quarantine: " + strings.Join(e.Reasons, ", ")
+}
+
+// Identifies an entry for the removal check: by handle, or by member id or
+// PIN if it has none. A changed PIN or secret does not count as removal.
+func memberKey(entry *Entry) string {
+	switch {
+	case entry.Handle != "":
+		return "handle " + entry.Handle
+	case entry.TOTP != "":
+		return "id " + entry.ID
+	}
+	return "pin " + entry.Pin
+}
+
+// Returns the reasons why replacing old with entries is suspicious.
+func (g Guards) check(old []Entry, entries []Entry) []string {
+	var reasons []string
+
+	if len(entries) < g.MinCount {
+		reasons = append(reasons, fmt.Sprintf("only %d PINs (minimum %d)", len(entries), g.MinCount))
+	}
+
+	seen := make(map[string]bool, len(entries))
+	seenIDs := make(map[string]bool)
+	malformed, duplicates := 0, 0
+	for _, entry := range entries {
+		if !entry.wellFormed() {
+			malformed++
+		}
+		for _, pin := range []string{entry.Pin, entry.DuressPin} {
+			if pin == "" {
+				continue
+			}
+			if seen[pin] {
+				duplicates++
+			}
+			seen[pin] = true
+		}
+		if entry.TOTP != "" {
+			if seenIDs[entry.ID] {
+				duplicates++
+			}
+			seenIDs[entry.ID] = true
+		}
+	}
+	if g.RejectMalformed && malformed > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d malformed entries", malformed))
+	}
+	if g.RejectDuplicates && duplicates > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d duplicate PINs", duplicates))
+	}
+
+	if g.MaxRemovedPercent > 0 && len(old) > 0 {
+		members := make(map[string]bool, len(entries))
+		for idx := range entries {
+			members[memberKey(&entries[idx])] = true
+		}
+		removed := 0
+		for idx := range old {
+			if !members[memberKey(&old[idx])] {
+				removed++
+			}
+		}
+		if percent := removed * 100 / len(old); percent > g.MaxRemovedPercent {
+			reasons = append(reasons, fmt.Sprintf("%d of %d entries removed (%d%%, maximum %d%%)",
+				removed, len(old), percent, g.MaxRemovedPercent))
+		}
+	}
+
+	return reasons
+}
+
+func validPin(pin string) bool {
+	if pin == "" {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Puts u into quarantine. The event is only published once per update, not
+// on every sync which downloads it again.
+func (ps *Pinstore) hold(src *source, u *update) error {
+	err := &QuarantineError{u.reasons}
+	if src.quarantine != nil && bytes.Equal(src.quarantine.checksum, u.checksum) {
+		return err
+	}
+	src.quarantine = u
+	if src.filename != "" {
+		if e := writeCache(ps.key, src.filename+".quarantine", u.body); e != nil {
+			fmt.Printf("pinstore: could not write quarantine file: %s\n", e)
+		}
+	}
+	events.Publish("pins.quarantined", "%s PINs: %s, confirm with confirm-pins", src.name, err)
+	return err
+}
+
+// Quarantined returns why the updates in quarantine were held, or nil if
+// there are none.
+func (ps *Pinstore) Quarantined() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var reasons []string
+	for _, src := range ps.sources {
+		if src.quarantine == nil {
+			continue
+		}
+		for _, reason := range src.quarantine.reasons {
+			reasons = append(reasons, src.name+": "+reason)
+		}
+	}
+	return reasons
+}
+
+// Confirm makes the updates in quarantine effective.
+func (ps *Pinstore) Confirm() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	confirmed := false
+	for _, src := range ps.sources {
+		if src.quarantine == nil {
+			continue
+		}
+		if err := ps.activate(src, src.quarantine); err != nil {
+			return err
+		}
+		src.quarantine = nil
+		confirmed = true
+		events.Publish("pins.confirmed", "quarantined %s PIN update confirmed, %d PINs active (generation %d)",
+			src.name, ps.Snapshot().Len(), ps.Generation())
+	}
+	if !confirmed {
+		return ErrNoQuarantine
+	}
+	if ps.OnConfirm != nil {
+		ps.OnConfirm()
+	}
+	return nil
+}
+
+// Reject discards the updates in quarantine. The same update will be held
+// again on the next sync, so this is only useful after fixing the BenutzerDB.
+func (ps *Pinstore) Reject() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	rejected := false
+	for _, src := range ps.sources {
+		if src.quarantine == nil {
+			continue
+		}
+		src.quarantine = nil
+		rejected = true
+		events.Publish("pins.rejected", "quarantined %s PIN update rejected", src.name)
+	}
+	if !rejected {
+		return ErrNoQuarantine
+	}
+	return nil
+}
@@ -2,162 +2,382 @@
 // © 2012 Michael Stapelberg (see also: LICENSE)
 //
 // Data structures, serialization and synchronization functions for the Pins.
+//
+// The PINs are synchronized using conditional requests: the ETag and
+// Last-Modified validators of the last response are sent along (If-None-Match,
+// If-Modified-Since) and the server answers with 304 Not Modified when the
+// PINs did not change. The validators are stored next to the PINs file in
+// <filename>.sync, so that they survive restarts.
+//
+// When a public key is configured, the PIN list must carry a detached Ed25519
+// signature of the response body, base64 encoded in the X-Pin-Signature
+// header. Lists without a valid signature are rejected before they replace
+// anything. The signature is stored in <filename>.sync as well, and the
+// stored PINs are verified again when they are loaded (see Options), so that
+// writing to the PINs file does not bypass the signature.
 package pinstore
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"hash/crc32"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"path"
-	"syscall"
-    "fmt"
-    "time"
-    "pinpad-controller/frontend"
+	"pinpad-controller/events"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var syncFailIndicatorRunning = false
-var lastSyncState bool = false
-var lastChecksum []byte
+// The HTTP header which carries the signature of the PIN list.
+const SIGNATURE_HEADER = "X-Pin-Signature"
 
-// This type is used temporarily when decoding the JSON only.
-type pin struct {
-	Handle string
-	Pin    string
+var (
+	ErrUnsigned     = errors.New("PIN list is not signed")
+	ErrBadSignature = errors.New("PIN list has an invalid signature")
+)
+
+// The HTTP validators of the last successful sync, stored in <filename>.sync.
+type validators struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	// The signature of the PINs (see SIGNATURE_HEADER).
+	Signature string `json:",omitempty"`
 }
 
 type Pinstore struct {
+	// Empty to keep everything in memory.
 	filename string
-	Pins     map[string]string
+	// If not nil, the PINs are encrypted on disk (see crypt.go).
+	key []byte
+	// The effective entries of all sources (see sources.go and
+	// snapshot.go).
+	snapshot atomic.Pointer[Snapshot]
+	// How many time steps a TOTP code may be off.
+	TOTPDrift int
+
+	// Serializes updates, confirmations of quarantined updates and thereby
+	// snapshot swaps.
+	mu sync.Mutex
+
+	// The sources in order of precedence. primary is the one synced by
+	// Update and stored in filename.
+	sources []*source
+	primary *source
+
+	// The HTTP client for syncs and usage reports (see client.go). nil
+	// means http.DefaultClient.
+	Client *http.Client
+
+	// Whether to ask the server for deltas (see diff.go).
+	Delta bool
+	// If not nil, called (with mu held) after the PINs of a source
+	// changed, e.g. to publish the number of changes.
+	OnChange func(source string, generation uint64, d *Diff)
+
+	// If not nil, updates need to be signed with the corresponding private
+	// key.
+	PublicKey ed25519.PublicKey
+
+	// Updates which violate the guards are held in quarantine until an
+	// admin confirms them. The zero value disables all guards.
+	Guards Guards
+	// If not nil, called (with mu held) after an update in quarantine was
+	// confirmed, e.g. Scheduler.SyncNow.
+	OnConfirm func()
+
+	// Whether the counters of removed limited-use PINs are kept until their
+	// uses were reported (see ReportUsage). Without, they are dropped with
+	// the PINs.
+	KeepUnreported bool
+
+	// Counters of limited-use PINs and the last used TOTP time steps,
+	// protected by usageMu (which is independent of mu, so that PINs can
+	// be used during a sync).
+	usageMu   sync.Mutex
+	usage     map[string]*usage
+	totpSteps map[string]int64
 }
 
-func Load(filename string) (*Pinstore, error) {
-	result := new(Pinstore)
-	result.filename = filename
-	result.Pins = make(map[string]string, 0)
+// A PIN list, either effective or downloaded but not effective yet.
+type update struct {
+	body []byte
+	// CRC32 of body. To save some I/O (we’re on a SD card!), updates with
+	// the same checksum are discarded.
+	checksum []byte
+	entries  []Entry
+	pins     map[string]*Entry
+	members  map[string]*Entry
+	duress   map[string]*Entry
+	// Validators of the response body was read from.
+	validators validators
+	// Why the update is held in quarantine.
+	reasons []string
+}
 
-	// Check if the file exists and load it, if so. Otherwise, create a new file.
-	if _, err := os.Stat(filename); err != nil {
-		// ENOENT is okay (we create a new file), but anything else is not.
-		if e, ok := err.(*os.PathError); ok && e.Err != syscall.ENOENT {
-			return nil, err
-		}
-	} else {
-		// Read the whole file into pinContents
-		pinContents, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
+// LoadPublicKey reads a base64 encoded Ed25519 public key from filename.
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: expected %d bytes, got %d", filename, ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
 
-		// The file is JSON encoded, so unmarshal it into the pins array first…
-		var pins []pin
-		if err := json.Unmarshal(pinContents, &pins); err != nil {
-			return nil, err
-		}
+// Verifies the signature (base64 encoded, as sent in SIGNATURE_HEADER) of
+// body. Returns nil if no public key is configured.
+func (ps *Pinstore) verify(body []byte, signature string) error {
+	if ps.PublicKey == nil {
+		return nil
+	}
+	if signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ps.PublicKey, body, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Parses the list of PINs in the given format.
+func parse(contents []byte, format string) (u *update, err error) {
+	u = new(update)
+	// Decode the contents into the entries array first…
+	if u.entries, err = decode(contents, format); err != nil {
+		return nil, err
+	}
 
-		// …then fill the Pins map for convenience
-		for _, pin := range pins {
-			result.Pins[pin.Pin] = pin.Handle
+	// …then fill the maps for convenience
+	entries := u.entries
+	u.pins = make(map[string]*Entry, len(entries))
+	u.members = make(map[string]*Entry)
+	u.duress = make(map[string]*Entry)
+	for idx := range entries {
+		entry := &entries[idx]
+		if entry.Pin != "" {
+			u.pins[entry.Pin] = entry
+		}
+		if entry.TOTP != "" {
+			u.members[entry.ID] = entry
+		}
+		if entry.DuressPin != "" {
+			u.duress[entry.DuressPin] = entry
 		}
 	}
+	return u, nil
+}
 
-	return result, nil
+// Loads the PINs (of the primary source) from filename, which is also where
+// Update stores them. With an empty filename, nothing is stored (e.g. for
+// tests).
+func Load(filename string) (*Pinstore, error) {
+	return LoadWithOptions(filename, Options{})
 }
 
-func indicateSyncFail(fe *frontend.Frontend) {
-    if (syncFailIndicatorRunning == true) {
-        return
-    }
-    syncFailIndicatorRunning = true
-    for {
-        if (lastSyncState == true) {
-            syncFailIndicatorRunning = false
-            return;
-        }
-        fe.LED(2, 1000)
-        fe.Beep(2)
-        time.Sleep(2 * time.Second)
-    }
+// LoadEncrypted is like Load, but the PINs are stored encrypted with key
+// (see crypt.go).
+func LoadEncrypted(filename string, key []byte) (*Pinstore, error) {
+	return LoadWithOptions(filename, Options{Key: key})
 }
 
-// Safely updates the pinstore contents with the contents from 'url'.
-func (ps *Pinstore) Update(url string, fe *frontend.Frontend) (err error) {
-    fmt.Printf("pinstore: trying to sync PINs\n")
+type Options struct {
+	// If not nil, the PINs are stored encrypted with Key (see crypt.go).
+	Key []byte
+	// If not nil, the PINs need to be signed with the corresponding
+	// private key. Stored PINs without valid signature are dropped.
+	PublicKey ed25519.PublicKey
+	// See Pinstore.KeepUnreported. Needs to be set on Load, which already
+	// drops the counters of removed PINs.
+	KeepUnreported bool
+}
 
-	resp, err := http.Get(url)
+// LoadWithOptions is like Load, with the given options.
+func LoadWithOptions(filename string, opts Options) (*Pinstore, error) {
+	key := opts.Key
+	if key != nil && len(key) != CACHE_KEY_SIZE {
+		return nil, fmt.Errorf("expected a key of %d bytes, got %d", CACHE_KEY_SIZE, len(key))
+	}
+	result := new(Pinstore)
+	result.filename = filename
+	result.key = key
+	result.PublicKey = opts.PublicKey
+	result.KeepUnreported = opts.KeepUnreported
+	result.TOTPDrift = 1
+	if err := result.loadUsage(); err != nil {
+		return nil, err
+	}
+	result.loadTOTPSteps()
+
+	primary, err := result.loadSource(SOURCE_PRIMARY, filename, false)
 	if err != nil {
-        fmt.Printf("pinstore: could not sync PINs: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
+	result.primary = primary
+	result.sources = []*source{primary}
+	result.merge()
+
+	return result, nil
+}
 
-	// To save some I/O (we’re on a SD card!) we calculate the hash of the
-	// contents while we read them and then discard the update in case it has
-	// the same content.
+func crc32Sum(contents []byte) []byte {
 	checksum := crc32.NewIEEE()
-	teeReader := io.TeeReader(resp.Body, checksum)
+	checksum.Write(contents)
+	return checksum.Sum(nil)
+}
+
+// Logs err. Failed syncs are indicated by the Scheduler.
+func syncFailed(err error) error {
+	fmt.Printf("pinstore: %s\n", err)
+	return err
+}
+
+// Safely updates the primary source with the contents from 'url'.
+func (ps *Pinstore) Update(url string) (err error) {
+	return ps.update(ps.primary, url)
+}
+
+func (ps *Pinstore) update(src *source, url string) (err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	fmt.Printf("pinstore: trying to sync %s PINs\n", src.name)
 
-	body, err := ioutil.ReadAll(teeReader)
+	defer func() {
+		src.lastSync = time.Now()
+		src.lastErr = err
+	}()
+
+	current := src.current
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-        fmt.Printf("pinstore: could not sync PINs: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-        return
+		return syncFailed(fmt.Errorf("could not sync PINs: %s", err))
+	}
+	if current.validators.ETag != "" {
+		req.Header.Set("If-None-Match", current.validators.ETag)
+	}
+	if current.validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", current.validators.LastModified)
+	}
+	// A delta needs to know which PINs it applies to. With a public key,
+	// only full lists are requested: the result of a delta has no
+	// signature, so it could not be verified when it is loaded.
+	if ps.Delta && ps.PublicKey == nil && current.validators.ETag != "" {
+		req.Header.Set("A-IM", DELTA_IM)
 	}
 
-	if bytes.Compare(checksum.Sum(nil), lastChecksum) == 0 {
-        lastSyncState = true
-		return
+	resp, err := ps.client().Do(req)
+	if err != nil {
+		return syncFailed(fmt.Errorf("could not sync PINs: %s", err))
 	}
+	defer resp.Body.Close()
 
-	lastChecksum = checksum.Sum(nil)
+	if resp.StatusCode == http.StatusNotModified {
+		fmt.Printf("pinstore: %s PINs not modified\n", src.name)
+		return nil
+	}
 
-	log.Printf("PINs changed, new CRC32: %x", lastChecksum)
+	isDelta := resp.StatusCode == STATUS_IM_USED && resp.Header.Get("IM") == DELTA_IM
+	if resp.StatusCode != http.StatusOK && !isDelta {
+		return syncFailed(fmt.Errorf("could not sync PINs: unexpected status %s", resp.Status))
+	}
 
-	// Save the new pins to a new file
-	file, err := ioutil.TempFile(path.Dir(ps.filename), path.Base(ps.filename)+".new")
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-        fmt.Printf("pinstore: could not get tmpfile: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-		return
+		return syncFailed(fmt.Errorf("could not sync PINs: %s", err))
 	}
 
-	if _, err = file.Write(body); err != nil {
-        fmt.Printf("pinstore: could not write PINs to tmpfile: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-		return
+	// Nothing may happen with unverified PINs.
+	if err := ps.verify(body, resp.Header.Get(SIGNATURE_HEADER)); err != nil {
+		fmt.Printf("pinstore: rejecting PINs from %s\n", url)
+		return syncFailed(err)
 	}
 
-	// Try to load the new file and copy the pins over if successful
-	newStore, err := Load(file.Name())
-	if err != nil {
-        fmt.Printf("pinstore: could not parse PINs: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-		return
+	format := formatByContentType(resp.Header.Get("Content-Type"))
+	if format == "" {
+		format = formatByExtension(req.URL.Path)
+	}
+	if isDelta {
+		// From here on, the resulting list is handled like a full one.
+		if body, err = applyDelta(current.entries, body); err != nil {
+			return syncFailed(err)
+		}
+		format = FORMAT_JSON
+	}
+	newValidators := validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Signature:    resp.Header.Get(SIGNATURE_HEADER),
 	}
 
-	ps.Pins = newStore.Pins
+	checksum := crc32Sum(body)
+	if bytes.Compare(checksum, current.checksum) == 0 {
+		// The server does not support (or ignored) the validators, but
+		// the PINs did not change.
+		if newValidators != current.validators {
+			current.validators = newValidators
+			src.saveValidators()
+		}
+		return nil
+	}
+
+	log.Printf("%s PINs changed, new CRC32: %x", src.name, checksum)
 
-	// Then rename the new file to the old name
-	err = os.Rename(file.Name(), ps.filename)
+	// Parse the new pins before writing anything
+	u, err := parse(body, format)
 	if err != nil {
-        fmt.Printf("pinstore: could not make new PINs effective: %s\n", err)
-        lastSyncState = false
-        go indicateSyncFail(fe)
-		return
+		return syncFailed(fmt.Errorf("could not parse PINs: %s", err))
 	}
+	u.body = body
+	u.checksum = checksum
+	u.validators = newValidators
 
-    lastSyncState = true
-    fmt.Printf("pinstore: pinsync successful\n")
+	if u.reasons = ps.Guards.check(current.entries, u.entries); len(u.reasons) > 0 {
+		return syncFailed(ps.hold(src, u))
+	}
+	src.quarantine = nil
 
-	return
+	if err := ps.activate(src, u); err != nil {
+		return syncFailed(err)
+	}
+
+	fmt.Printf("pinstore: pinsync successful\n")
+
+	return nil
+}
+
+// Writes the update to the file of src and makes it effective.
+func (ps *Pinstore) activate(src *source, u *update) error {
+	if src.filename != "" {
+		if err := writeCache(ps.key, src.filename, u.body); err != nil {
+			return fmt.Errorf("could not make new PINs effective: %s", err)
+		}
+	}
+
+	d := diff(src.current.entries, u.entries)
+	src.current = u
+	src.saveValidators()
+	ps.merge()
+	ps.usageMu.Lock()
+	ps.pruneUsage(src, ps.Snapshot())
+	ps.usageMu.Unlock()
+	if !d.Empty() {
+		events.Publish("pins.changed", "%s PINs (generation %d): %s", src.name, ps.Generation(), d)
+		if ps.OnChange != nil {
+			ps.OnChange(src.name, ps.Generation(), d)
+		}
+	}
+	return nil
 }
@@ -5,15 +5,34 @@
 package pinstore
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"pinpad-controller/events"
+	"strings"
 	"testing"
 	"time"
 )
 
+// Returns the path of pins.json in a temporary directory, which is removed
+// when the test is done. The files (by name, e.g. "pins.json" or
+// "pins.json.uses") are written to the directory first.
+func tempPins(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path.Join(dir, "pins.json")
+}
+
 func TestPinstoreLoad(t *testing.T) {
 	// Write a pin test file
 	tempfile, temperr := ioutil.TempFile("/tmp/", "pinstore_test")
@@ -21,6 +40,7 @@ func TestPinstoreLoad(t *testing.T) {
 		t.Fatal("Could not create temporary file")
 	}
 	defer os.Remove(tempfile.Name())
+	defer os.Remove(tempfile.Name() + ".sync")
 
 	fmt.Fprintf(tempfile, `[
 	{"pin":"590023", "handle":"secure"},
@@ -32,7 +52,7 @@ func TestPinstoreLoad(t *testing.T) {
 		t.Fatal("Could not create pinstore object:", err)
 	}
 
-	if val, ok := store.Pins["590023"]; !ok || val != "secure" {
+	if val, ok := store.Lookup("590023"); !ok || val.Handle != "secure" {
 		t.Error(`Pin for "secure" not found`)
 	}
 
@@ -47,11 +67,249 @@ func TestPinstoreLoad(t *testing.T) {
 
 	store.Update("http://localhost:8099/pins")
 
-	if val, ok := store.Pins["1"]; !ok || val != "revoked?" {
+	if val, ok := store.Lookup("1"); !ok || val.Handle != "revoked?" {
 		t.Fatal("New pin not found after updating")
 	}
 
-	if _, ok := store.Pins["590023"]; ok {
+	if _, ok := store.Lookup("590023"); ok {
 		t.Fatal("Old pin still in pinstore after updating")
 	}
 }
+
+func TestConditionalUpdate(t *testing.T) {
+	filename := tempPins(t, nil)
+
+	const etag = `"v1"`
+	full, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Wed, 02 Jan 2013 15:04:05 GMT")
+		io.WriteString(w, `[{"handle":"secure", "pin":"590023"}]`)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if full != 1 || notModified != 1 {
+		t.Fatalf("Expected 1 full and 1 conditional request, got %d and %d", full, notModified)
+	}
+
+	// The validators survive a restart.
+	store, err = Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.primary.current.validators.LastModified != "Wed, 02 Jan 2013 15:04:05 GMT" {
+		t.Errorf("Last-Modified not restored, got %q", store.primary.current.validators.LastModified)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if full != 1 || notModified != 2 {
+		t.Fatalf("Expected a conditional request after Load, got %d full requests", full)
+	}
+	if val, ok := store.Lookup("590023"); !ok || val.Handle != "secure" {
+		t.Error(`Pin for "secure" not found`)
+	}
+}
+
+func TestUpdateError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	filename := tempPins(t, map[string]string{"pins.json": `[{"handle":"secure", "pin":"590023"}]`})
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err == nil {
+		t.Fatal("Update did not fail for status 503")
+	}
+	if _, ok := store.Lookup("590023"); !ok {
+		t.Error("Pins were replaced after a failed update")
+	}
+}
+
+func TestSignedUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := tempPins(t, map[string]string{"pubkey": base64.StdEncoding.EncodeToString(publicKey) + "\n"})
+	keyFile := path.Join(path.Dir(filename), "pubkey")
+
+	body := []byte(`[{"handle":"secure", "pin":"590023"}]`)
+	signature := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signature != "" {
+			w.Header().Set(SIGNATURE_HEADER, signature)
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.PublicKey, err = LoadPublicKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Update(server.URL); err != ErrUnsigned {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+
+	otherKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signature = base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, body))
+	if err := store.Update(server.URL); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+
+	if store.Snapshot().Len() != 0 {
+		t.Fatal("Pins were replaced by an unverified list")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal("Unverified list was written to disk")
+	}
+
+	signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, body))
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := store.Lookup("590023"); !ok || val.Handle != "secure" {
+		t.Error(`Pin for "secure" not found`)
+	}
+
+	// The signature is stored, so the PINs are still good after a restart…
+	store, err = LoadWithOptions(filename, Options{PublicKey: publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup("590023"); !ok {
+		t.Error(`Pin for "secure" not found after LoadWithOptions`)
+	}
+
+	// …but modified PINs are dropped.
+	if err := ioutil.WriteFile(filename, []byte(`[{"handle":"evil", "pin":"666666"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err = LoadWithOptions(filename, Options{PublicKey: publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Snapshot().Len() != 0 {
+		t.Error("Modified PINs were loaded")
+	}
+	if store.primary.current.validators.ETag != "" || store.primary.current.validators.Signature != "" {
+		t.Error("Validators of dropped PINs were kept")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	filename := tempPins(t, nil)
+
+	body := `[{"handle":"secure", "pin":"590023"}, {"handle":"meh", "pin":"992211"}, {"handle":"x", "pin":"123456"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Guards = DefaultGuards
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	for _, suspicious := range []string{
+		`[]`,
+		`[{"handle":"secure", "pin":"590023"}]`,
+		`[{"handle":"secure", "pin":"590023"}, {"handle":"meh", "pin":"590023"}]`,
+		`[{"handle":"secure", "pin":"590023"}, {"handle":"", "pin":"992211"}, {"handle":"x", "pin":"12ab"}]`,
+	} {
+		body = suspicious
+		err := store.Update(server.URL)
+		if _, ok := err.(*QuarantineError); !ok {
+			t.Fatalf("Update of %s: expected QuarantineError, got %v", suspicious, err)
+		}
+		if store.Snapshot().Len() != 3 {
+			t.Fatalf("Update of %s replaced the PINs", suspicious)
+		}
+		if event := <-ch; event.Type != "pins.quarantined" {
+			t.Errorf("Unexpected event %v", event)
+		}
+		if contents, _ := ioutil.ReadFile(filename + ".quarantine"); string(contents) != suspicious {
+			t.Errorf("Quarantine file contains %q", contents)
+		}
+	}
+
+	// Syncing the same update again does not publish another event.
+	if err := store.Update(server.URL); err == nil {
+		t.Fatal("Update did not hold the update again")
+	}
+	if len(ch) != 0 {
+		t.Error("Event published again for the same update")
+	}
+
+	if store.Quarantined() == nil {
+		t.Fatal("Quarantined() returned nil")
+	}
+	confirmed := 0
+	store.OnConfirm = func() { confirmed++ }
+	if err := store.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed != 1 {
+		t.Errorf("OnConfirm called %d times", confirmed)
+	}
+	secure, _ := store.Lookup("590023")
+	x, _ := store.Lookup("12ab")
+	if store.Snapshot().Len() != 3 || secure == nil || secure.Handle != "secure" || x == nil || x.Handle != "x" {
+		t.Errorf("Unexpected PINs after Confirm: %s", store.Status())
+	}
+	if err := store.Confirm(); err != ErrNoQuarantine {
+		t.Errorf("Expected ErrNoQuarantine, got %v", err)
+	}
+}
+
+func TestGuardsCountMembers(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	old := []Entry{
+		{Handle: "secure", Pin: "590023"},
+		{Handle: "meh", ID: "42", TOTP: secret},
+		{Handle: "x", ID: "43", TOTP: secret},
+	}
+
+	// Dropping the TOTP members removes two of three entries…
+	if reasons := DefaultGuards.check(old, old[:1]); len(reasons) != 1 || !strings.Contains(reasons[0], "2 of 3 entries removed") {
+		t.Errorf("Unexpected reasons for removing the TOTP members: %v", reasons)
+	}
+	// …while a member switching from TOTP to a static PIN is no removal.
+	changed := []Entry{old[0], {Handle: "meh", Pin: "992211"}, old[2]}
+	if reasons := DefaultGuards.check(old, changed); len(reasons) != 0 {
+		t.Errorf("Unexpected reasons for changing a member: %v", reasons)
+	}
+}
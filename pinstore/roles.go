@@ -0,0 +1,109 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Roles and their permissions. The role of an entry is given in the PIN list
+// ("role": "guest"), entries without role are members.
+package pinstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Permission int
+
+const (
+	PERM_OPEN = Permission(1 << iota)
+	PERM_CLOSE
+	// Use the admin menu of the keypad.
+	PERM_ADMIN
+	// Open the door outside of the opening hours.
+	PERM_OUTSIDE_SCHEDULE
+)
+
+func (p Permission) String() string {
+	names := []string{"open", "close", "admin", "outside-schedule"}
+	var result []string
+	for bit, name := range names {
+		if p&(1<<uint(bit)) != 0 {
+			result = append(result, name)
+		}
+	}
+	if len(result) == 0 {
+		return "none"
+	}
+	return strings.Join(result, ",")
+}
+
+const DEFAULT_ROLE = "member"
+
+var Roles = map[string]Permission{
+	"guest":     PERM_OPEN,
+	"member":    PERM_OPEN | PERM_CLOSE,
+	"keyholder": PERM_OPEN | PERM_CLOSE | PERM_OUTSIDE_SCHEDULE,
+	"admin":     PERM_OPEN | PERM_CLOSE | PERM_OUTSIDE_SCHEDULE | PERM_ADMIN,
+}
+
+func (e *Entry) role() string {
+	if e.Role == "" {
+		return DEFAULT_ROLE
+	}
+	return e.Role
+}
+
+// Can returns whether the role of the entry has the permission. Entries with
+// an unknown role have no permissions.
+func (e *Entry) Can(perm Permission) bool {
+	return Roles[e.role()]&perm == perm
+}
+
+// ParseWindows parses a schedule like "mon,tue,wed 18:00-23:00;sat 10:00-22:00".
+// The days may be omitted to mean every day.
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var w Window
+		fields := strings.Fields(part)
+		if len(fields) == 2 {
+			for _, day := range strings.Split(fields[0], ",") {
+				weekday, ok := weekdays[strings.ToLower(day)]
+				if !ok {
+					return nil, fmt.Errorf("invalid day %q (expected mon, tue, …)", day)
+				}
+				w.Days = append(w.Days, weekday)
+			}
+			fields = fields[1:]
+		}
+		times := strings.Split(fields[0], "-")
+		if len(fields) != 1 || len(times) != 2 {
+			return nil, fmt.Errorf("invalid window %q (expected e.g. mon,tue 18:00-23:00)", part)
+		}
+		var err error
+		if w.From, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if w.Until, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// InWindows returns whether t is within one of the windows. No windows means
+// always.
+func InWindows(windows []Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for roles and schedules.
+package pinstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCan(t *testing.T) {
+	for _, test := range []struct {
+		entry Entry
+		perm  Permission
+		can   bool
+	}{
+		{Entry{}, PERM_OPEN, true},
+		{Entry{}, PERM_CLOSE, true},
+		{Entry{}, PERM_OUTSIDE_SCHEDULE, false},
+		{Entry{Role: "guest"}, PERM_CLOSE, false},
+		{Entry{Role: "keyholder"}, PERM_OUTSIDE_SCHEDULE, true},
+		{Entry{Role: "keyholder"}, PERM_ADMIN, false},
+		{Entry{Role: "admin"}, PERM_ADMIN | PERM_CLOSE, true},
+		{Entry{Role: "janitor"}, PERM_OPEN, false},
+	} {
+		if can := test.entry.Can(test.perm); can != test.can {
+			t.Errorf("Role %q, %s: expected %v, got %v", test.entry.Role, test.perm, test.can, can)
+		}
+	}
+
+	if (&Entry{Handle: "x", Pin: "123456", Role: "janitor"}).wellFormed() {
+		t.Error("Entry with unknown role is well-formed")
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("mon,tue 18:00-23:00; 10:00-12:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Window{
+		{Days: []time.Weekday{time.Monday, time.Tuesday}, From: 18 * time.Hour, Until: 23 * time.Hour},
+		{From: 10 * time.Hour, Until: 12 * time.Hour},
+	}
+	if len(windows) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, windows)
+	}
+	for idx := range expected {
+		if windows[idx].From != expected[idx].From || windows[idx].Until != expected[idx].Until ||
+			len(windows[idx].Days) != len(expected[idx].Days) {
+			t.Errorf("Window %d: expected %v, got %v", idx, expected[idx], windows[idx])
+		}
+	}
+
+	// 2013-01-07 is a monday.
+	monday := time.Date(2013, 1, 7, 19, 0, 0, 0, time.Local)
+	if !InWindows(windows, monday) || InWindows(windows, monday.Add(48*time.Hour)) {
+		t.Error("InWindows returned the wrong result")
+	}
+	if !InWindows(nil, monday) {
+		t.Error("No windows should mean always")
+	}
+
+	for _, invalid := range []string{"mon", "noon-midnight", "xyz 10:00-12:00", "mon 10:00-12:00 extra"} {
+		if _, err := ParseWindows(invalid); err == nil {
+			t.Errorf("No error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The Scheduler syncs the PINs periodically. After failed syncs, it backs off
+// exponentially (with some jitter, so that a recovering BenutzerDB is not hit
+// by all controllers at once).
+//
+// A single failed sync is no reason to worry, the PINs on the SD card are
+// still good. Only after StaleAfter without a successful sync, the display
+// shows a warning, and only after FailingAfter, the keypad beeps and blinks
+// so that someone takes care of it. Changes of the state are published as
+// sync.state events.
+//
+// An update which is held in quarantine (see guards.go) was downloaded just
+// fine, so it does not count as a failed sync. Instead, the state is
+// SYNC_HELD until the update is confirmed (see SyncNow) or the BenutzerDB
+// sends an acceptable list.
+package pinstore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"pinpad-controller/events"
+	"pinpad-controller/frontend"
+	"sync"
+	"time"
+)
+
+type SyncState int
+
+const (
+	// The last sync succeeded, or the failures did not last for StaleAfter
+	// yet.
+	SYNC_OK = SyncState(iota)
+	// No successful sync for StaleAfter.
+	SYNC_STALE
+	// No successful sync for FailingAfter.
+	SYNC_FAILING
+	// The syncs succeed, but the update is held in quarantine.
+	SYNC_HELD
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SYNC_OK:
+		return "ok"
+	case SYNC_STALE:
+		return "stale"
+	case SYNC_FAILING:
+		return "failing"
+	case SYNC_HELD:
+		return "held"
+	}
+	return fmt.Sprintf("SyncState(%d)", int(s))
+}
+
+type SyncStatus struct {
+	State SyncState
+	// When the last sync succeeded (or the Scheduler was started, if no
+	// sync succeeded yet).
+	LastSuccess time.Time
+	// How many syncs failed in a row and why the last one failed.
+	Failures int
+	Reason   string
+	NextSync time.Time
+}
+
+func (s SyncStatus) String() string {
+	var result string
+	switch s.State {
+	case SYNC_OK:
+		result = "ok, last sync " + s.LastSuccess.Format(time.RFC3339)
+		if s.Failures > 0 {
+			result += fmt.Sprintf(", %d failed since: %s", s.Failures, s.Reason)
+		}
+	case SYNC_STALE:
+		result = fmt.Sprintf("stale since %s: %s", s.LastSuccess.Format(time.RFC3339), s.Reason)
+	case SYNC_HELD:
+		result = fmt.Sprintf("held, last sync %s: %s", s.LastSuccess.Format(time.RFC3339), s.Reason)
+	default:
+		result = fmt.Sprintf("failing since %s (%d attempts): %s",
+			s.LastSuccess.Format(time.RFC3339), s.Failures, s.Reason)
+	}
+	if !s.NextSync.IsZero() {
+		result += ", next sync " + s.NextSync.Format(time.RFC3339)
+	}
+	return result
+}
+
+type Scheduler struct {
+	// How often to sync while syncs succeed.
+	Interval time.Duration
+	// The upper limit of the backoff after failed syncs.
+	MaxInterval time.Duration
+	// How long syncs may fail before the state is SYNC_STALE and
+	// SYNC_FAILING.
+	StaleAfter   time.Duration
+	FailingAfter time.Duration
+	// Indicate the state, e.g. all keypads.
+	Frontends []*frontend.Frontend
+
+	sync func() error
+	// Wakes up Run for an immediate sync, see SyncNow.
+	kick chan bool
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	failures    int
+	lastErr     error
+	// The update in quarantine, if the last successful sync held it.
+	held     *QuarantineError
+	nextSync time.Time
+}
+
+// NewScheduler returns a Scheduler which calls sync (e.g. Update and
+// UpdateSecondary) with the default intervals.
+func NewScheduler(sync func() error) *Scheduler {
+	return &Scheduler{
+		Interval:     1 * time.Minute,
+		MaxInterval:  30 * time.Minute,
+		StaleAfter:   10 * time.Minute,
+		FailingAfter: 1 * time.Hour,
+		sync:         sync,
+		kick:         make(chan bool, 1),
+		lastSuccess:  time.Now(),
+	}
+}
+
+// SyncNow makes Run sync right away instead of waiting for the next sync,
+// e.g. after an update in quarantine was confirmed.
+func (s *Scheduler) SyncNow() {
+	select {
+	case s.kick <- true:
+	default:
+	}
+}
+
+// Run syncs right away and then periodically. It never returns.
+func (s *Scheduler) Run() {
+	go func() {
+		state := SYNC_OK
+		for {
+			state = s.indicate(state, time.Now())
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	for {
+		err := s.sync()
+		now := time.Now()
+		s.mu.Lock()
+		s.record(err, now)
+		delay := s.delay()
+		s.nextSync = now.Add(delay)
+		s.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-s.kick:
+		}
+	}
+}
+
+// Records the result of a sync. A held update counts as success. Must be
+// called with mu held.
+func (s *Scheduler) record(err error, t time.Time) {
+	var held *QuarantineError
+	if err == nil || errors.As(err, &held) {
+		s.lastSuccess = t
+		s.failures = 0
+		s.lastErr = nil
+		s.held = held
+		return
+	}
+	s.failures++
+	s.lastErr = err
+}
+
+// Returns how long to wait until the next sync: Interval, doubled with every
+// failed sync up to MaxInterval, minus up to a fifth at random. Must be
+// called with mu held.
+func (s *Scheduler) delay() time.Duration {
+	delay := s.Interval
+	for i := 0; i < s.failures && delay < s.MaxInterval; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxInterval {
+		delay = s.MaxInterval
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// Status returns the current state of the sync.
+func (s *Scheduler) Status() SyncStatus {
+	return s.statusAt(time.Now())
+}
+
+func (s *Scheduler) statusAt(t time.Time) SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := SyncStatus{
+		LastSuccess: s.lastSuccess,
+		Failures:    s.failures,
+		NextSync:    s.nextSync,
+	}
+	if s.lastErr != nil {
+		status.Reason = s.lastErr.Error()
+	}
+	if s.failures > 0 {
+		if t.Sub(s.lastSuccess) >= s.FailingAfter {
+			status.State = SYNC_FAILING
+		} else if t.Sub(s.lastSuccess) >= s.StaleAfter {
+			status.State = SYNC_STALE
+		}
+	}
+	if status.State == SYNC_OK && s.held != nil {
+		status.State = SYNC_HELD
+		status.Reason = s.held.Error()
+	}
+	return status
+}
+
+// Publishes changes of the state (compared to last) and indicates the state
+// at t on the Frontends. Returns the state at t.
+func (s *Scheduler) indicate(last SyncState, t time.Time) SyncState {
+	status := s.statusAt(t)
+	if status.State != last {
+		events.Publish("sync.state", "%s", status)
+		warning := ""
+		switch status.State {
+		case SYNC_STALE:
+			warning = string(frontend.ICON_SYNC_WARNING) + "Sync stale"
+		case SYNC_FAILING:
+			warning = string(frontend.ICON_SYNC_WARNING) + "Sync fail"
+		case SYNC_HELD:
+			warning = string(frontend.ICON_SYNC_WARNING) + "Sync held"
+		}
+		for _, fe := range s.Frontends {
+			fe.Screen.SetWarning(warning)
+		}
+	}
+	if status.State == SYNC_FAILING {
+		for _, fe := range s.Frontends {
+			fe.LED(2, 1000)
+			fe.Beep(2)
+		}
+	}
+	return status.State
+}
@@ -0,0 +1,118 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the sync scheduler.
+package pinstore
+
+import (
+	"errors"
+	"pinpad-controller/events"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackoff(t *testing.T) {
+	s := NewScheduler(nil)
+	for _, test := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{0, 1 * time.Minute},
+		{1, 2 * time.Minute},
+		{3, 8 * time.Minute},
+		{5, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	} {
+		s.failures = test.failures
+		for i := 0; i < 100; i++ {
+			if delay := s.delay(); delay > test.max || delay < test.max*4/5 {
+				t.Fatalf("%d failures: delay %s not within [%s, %s]", test.failures, delay, test.max*4/5, test.max)
+			}
+		}
+	}
+}
+
+func TestSchedulerState(t *testing.T) {
+	s := NewScheduler(nil)
+	start := s.lastSuccess
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	s.record(errors.New("connection refused"), start.Add(time.Minute))
+	state := s.indicate(SYNC_OK, start.Add(time.Minute))
+	if state != SYNC_OK || len(ch) != 0 {
+		t.Fatalf("A single failed sync changed the state to %s", state)
+	}
+	if status := s.statusAt(start.Add(time.Minute)); status.Failures != 1 || status.Reason != "connection refused" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	for _, test := range []struct {
+		after    time.Duration
+		expected SyncState
+		message  string
+	}{
+		{10 * time.Minute, SYNC_STALE, "stale since "},
+		{30 * time.Minute, SYNC_STALE, ""},
+		{time.Hour, SYNC_FAILING, "failing since "},
+	} {
+		state = s.indicate(state, start.Add(test.after))
+		if state != test.expected {
+			t.Errorf("After %s: expected %s, got %s", test.after, test.expected, state)
+		}
+		if test.message == "" {
+			if len(ch) != 0 {
+				t.Errorf("After %s: unexpected event %v", test.after, <-ch)
+			}
+			continue
+		}
+		if event := <-ch; event.Type != "sync.state" ||
+			!strings.HasPrefix(event.Message, test.message) || !strings.Contains(event.Message, "connection refused") {
+			t.Errorf("After %s: unexpected event %v", test.after, event)
+		}
+	}
+
+	s.record(nil, start.Add(2*time.Hour))
+	if state = s.indicate(state, start.Add(2*time.Hour)); state != SYNC_OK {
+		t.Errorf("Expected ok after a successful sync, got %s", state)
+	}
+	if event := <-ch; event.Type != "sync.state" || !strings.HasPrefix(event.Message, "ok, last sync ") {
+		t.Errorf("Unexpected event %v", event)
+	}
+}
+
+func TestSchedulerHeld(t *testing.T) {
+	s := NewScheduler(nil)
+	start := s.lastSuccess
+
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	// A held update is no failure, not even after FailingAfter.
+	s.record(&QuarantineError{[]string{"only 0 PINs (minimum 1)"}}, start.Add(time.Minute))
+	state := s.indicate(SYNC_OK, start.Add(time.Minute))
+	if state != SYNC_HELD {
+		t.Fatalf("Expected held, got %s", state)
+	}
+	if event := <-ch; event.Type != "sync.state" ||
+		!strings.HasPrefix(event.Message, "held, last sync ") || !strings.Contains(event.Message, "only 0 PINs") {
+		t.Errorf("Unexpected event %v", event)
+	}
+	s.record(&QuarantineError{[]string{"only 0 PINs (minimum 1)"}}, start.Add(2*time.Hour))
+	if state = s.indicate(state, start.Add(2*time.Hour)); state != SYNC_HELD {
+		t.Errorf("Expected held after 2h, got %s", state)
+	}
+
+	// SyncNow does not block, even if nobody waits.
+	s.SyncNow()
+	s.SyncNow()
+	if len(s.kick) != 1 {
+		t.Error("SyncNow did not wake up Run")
+	}
+
+	s.record(nil, start.Add(2*time.Hour))
+	if state = s.indicate(state, start.Add(2*time.Hour)); state != SYNC_OK {
+		t.Errorf("Expected ok after the update was confirmed, got %s", state)
+	}
+}
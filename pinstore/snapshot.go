@@ -0,0 +1,82 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// The effective entries of all sources are kept in an immutable Snapshot.
+// Syncs build a new Snapshot and swap it in atomically, so that the keypads
+// can look up PINs at any time without locking and always see a consistent
+// set of entries.
+//
+// Every Snapshot has a generation number, which is incremented with every
+// swap. Status output and events (and thereby the audit log) mention it, so
+// that one can tell which PIN list was effective when a PIN was used.
+package pinstore
+
+import (
+	"time"
+)
+
+type Snapshot struct {
+	Generation uint64
+	// When the snapshot became effective.
+	Time time.Time
+
+	// Entries by PIN.
+	pins map[string]*Entry
+	// Entries with a TOTP secret by member id.
+	members map[string]*Entry
+	// Entries with a duress PIN by duress PIN.
+	duress map[string]*Entry
+}
+
+// Lookup returns the entry with the given PIN (not the duress PIN).
+func (s *Snapshot) Lookup(pin string) (*Entry, bool) {
+	entry, ok := s.pins[pin]
+	return entry, ok
+}
+
+// LookupDuress returns the entry with the given duress PIN.
+func (s *Snapshot) LookupDuress(pin string) (*Entry, bool) {
+	entry, ok := s.duress[pin]
+	return entry, ok
+}
+
+// LookupMember returns the entry with a TOTP secret of the given member id.
+func (s *Snapshot) LookupMember(id string) (*Entry, bool) {
+	entry, ok := s.members[id]
+	return entry, ok
+}
+
+// Len returns the number of PINs.
+func (s *Snapshot) Len() int {
+	return len(s.pins)
+}
+
+// Entries returns every entry once, even if it has a PIN and a TOTP secret.
+func (s *Snapshot) Entries() []*Entry {
+	seen := make(map[*Entry]bool)
+	var entries []*Entry
+	for _, m := range []map[string]*Entry{s.pins, s.members, s.duress} {
+		for _, entry := range m {
+			if !seen[entry] {
+				seen[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// Snapshot returns the effective entries. The Snapshot is never modified, so
+// it can be used as long as needed.
+func (ps *Pinstore) Snapshot() *Snapshot {
+	return ps.snapshot.Load()
+}
+
+// Lookup returns the effective entry with the given PIN.
+func (ps *Pinstore) Lookup(pin string) (*Entry, bool) {
+	return ps.Snapshot().Lookup(pin)
+}
+
+// Generation returns the generation of the effective entries.
+func (ps *Pinstore) Generation() uint64 {
+	return ps.Snapshot().Generation
+}
@@ -0,0 +1,77 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the snapshots of the effective entries.
+package pinstore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	filename := tempPins(t, map[string]string{"pins.json": `[{"handle":"secure", "pin":"590023"}]`})
+
+	var mu sync.Mutex
+	body := `[{"handle":"other", "pin":"590023"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := store.Snapshot()
+	if old.Generation != 1 {
+		t.Errorf("Expected generation 1 after Load, got %d", old.Generation)
+	}
+
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := old.Lookup("590023"); !ok || entry.Handle != "secure" || entry.Generation != 1 {
+		t.Errorf("Old snapshot was modified: %+v", entry)
+	}
+	if entry, ok := store.Lookup("590023"); !ok || entry.Handle != "other" || entry.Generation != 2 {
+		t.Errorf("Unexpected entry after Update: %+v", entry)
+	}
+	if store.Generation() != 2 {
+		t.Errorf("Expected generation 2 after Update, got %d", store.Generation())
+	}
+	if status := store.Status(); !strings.HasPrefix(status, "generation 2, ") {
+		t.Errorf("Status does not mention the generation: %s", status)
+	}
+
+	// Look up PINs while syncing (run with -race).
+	done := make(chan bool)
+	go func() {
+		for idx := 0; idx < 20; idx++ {
+			mu.Lock()
+			body = fmt.Sprintf(`[{"handle":"secure%d", "pin":"590023"}]`, idx)
+			mu.Unlock()
+			store.Update(server.URL)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if store.Generation() != 22 {
+				t.Errorf("Expected generation 22, got %d", store.Generation())
+			}
+			return
+		default:
+			if entry, ok := store.Lookup("590023"); !ok || !strings.HasPrefix(entry.Handle, "secure") && entry.Handle != "other" {
+				t.Fatalf("Unexpected entry %+v", entry)
+			}
+		}
+	}
+}
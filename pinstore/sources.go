@@ -0,0 +1,254 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// PINs can come from several sources. In order of precedence:
+//
+//  1. emergency: a local file which is only read, never written by a sync
+//     (see LoadEmergency). Meant for keyholders, so that the door still
+//     works if the BenutzerDB drops them by mistake.
+//  2. primary: the BenutzerDB (see Update), stored in the file given to Load.
+//  3. secondary: an optional second URL (see AddSecondary and
+//     UpdateSecondary).
+//
+// If the same PIN (or member id) is in several sources, the entry of the
+// source with the highest precedence is effective. Entry.Source tells which
+// source an effective entry is from.
+package pinstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pinpad-controller/events"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SOURCE_EMERGENCY = "emergency"
+	SOURCE_PRIMARY   = "primary"
+	SOURCE_SECONDARY = "secondary"
+)
+
+type source struct {
+	name     string
+	filename string
+	// Static sources are never synced.
+	static     bool
+	current    *update
+	quarantine *update
+	// When the last sync finished and its error.
+	lastSync time.Time
+	lastErr  error
+}
+
+// Loads a source from filename. A missing file is okay for sources which are
+// synced (it is created by the first sync). Synced sources without filename
+// are kept in memory. Plain text files of synced sources are encrypted if key
+// is not nil. With a public key, the PINs of synced sources without valid
+// signature are dropped (until the next sync).
+func (ps *Pinstore) loadSource(name string, filename string, static bool) (*source, error) {
+	src := &source{name: name, filename: filename, static: static}
+	key := ps.key
+
+	contents, encrypted, err := readCache(key, filename)
+	if (filename == "" || os.IsNotExist(err)) && !static {
+		src.current, _ = parse([]byte("[]"), FORMAT_JSON)
+		return src, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != nil && !encrypted && !static {
+		if err := writeCache(key, filename, contents); err != nil {
+			return nil, err
+		}
+		fmt.Printf("pinstore: encrypted %s\n", filename)
+	}
+	if key != nil && !static {
+		// Left over from a held update before the key was configured.
+		if err := encryptLeftover(key, filename+".quarantine"); err != nil {
+			return nil, err
+		}
+	}
+
+	// The validators are only meaningful together with the PINs they belong
+	// to. A missing or broken .sync file just leads to a full download.
+	var v validators
+	if !static {
+		if contents, err := ioutil.ReadFile(filename + ".sync"); err == nil {
+			if err := json.Unmarshal(contents, &v); err != nil {
+				fmt.Printf("pinstore: ignoring %s.sync: %s\n", filename, err)
+				v = validators{}
+			}
+		}
+	}
+
+	// The emergency file is written by hand and therefore trusted.
+	if !static {
+		if err := ps.verify(contents, v.Signature); err != nil {
+			fmt.Printf("pinstore: dropping %s: %s\n", filename, err)
+			events.Publish("pins.unverified", "stored %s PINs dropped: %s", name, err)
+			src.current, _ = parse([]byte("[]"), FORMAT_JSON)
+			return src, nil
+		}
+	}
+
+	// Synced files are stored in the format they were downloaded in,
+	// which is not necessarily the one of their extension.
+	format := formatByExtension(filename)
+	if !static {
+		format = formatByContent(contents)
+	}
+	if src.current, err = parse(contents, format); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	src.current.checksum = crc32Sum(contents)
+	src.current.validators = v
+	return src, nil
+}
+
+// Stores the validators in <filename>.sync. Errors are only logged, the worst
+// outcome is an unnecessary download after a restart.
+func (src *source) saveValidators() {
+	if src.filename == "" {
+		return
+	}
+	contents, err := json.Marshal(src.current.validators)
+	if err != nil {
+		fmt.Printf("pinstore: could not encode validators: %s\n", err)
+		return
+	}
+	if err := writeAtomic(src.filename+".sync", contents); err != nil {
+		fmt.Printf("pinstore: could not save validators: %s\n", err)
+	}
+}
+
+// Rebuilds the effective entries from all sources and swaps in the new
+// snapshot. Must be called with mu held (or before the Pinstore is used).
+func (ps *Pinstore) merge() {
+	snapshot := &Snapshot{
+		Time:    time.Now(),
+		pins:    make(map[string]*Entry),
+		members: make(map[string]*Entry),
+		duress:  make(map[string]*Entry),
+	}
+	if old := ps.snapshot.Load(); old != nil {
+		snapshot.Generation = old.Generation
+	}
+	snapshot.Generation++
+
+	// The entries of older snapshots may still be in use, so the entries
+	// are copied instead of modified. The copies are shared between the
+	// maps, like the entries of the sources.
+	copies := make(map[*Entry]*Entry)
+	copyOf := func(src *source, entry *Entry) *Entry {
+		if c, ok := copies[entry]; ok {
+			return c
+		}
+		c := *entry
+		c.Source = src.name
+		c.Generation = snapshot.Generation
+		copies[entry] = &c
+		return &c
+	}
+	// Sources with higher precedence overwrite the others.
+	for idx := len(ps.sources) - 1; idx >= 0; idx-- {
+		src := ps.sources[idx]
+		for pin, entry := range src.current.pins {
+			snapshot.pins[pin] = copyOf(src, entry)
+		}
+		for id, entry := range src.current.members {
+			snapshot.members[id] = copyOf(src, entry)
+		}
+		for pin, entry := range src.current.duress {
+			snapshot.duress[pin] = copyOf(src, entry)
+		}
+	}
+	ps.snapshot.Store(snapshot)
+	events.Publish("pins.generation", "generation %d effective, %d PINs", snapshot.Generation, snapshot.Len())
+}
+
+// LoadEmergency adds the static source from filename, which takes precedence
+// over all other sources. The file is read once and never written.
+func (ps *Pinstore) LoadEmergency(filename string) error {
+	src, err := ps.loadSource(SOURCE_EMERGENCY, filename, true)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.sources = append([]*source{src}, ps.sources...)
+	ps.merge()
+	return nil
+}
+
+// AddSecondary adds the secondary source, which has the lowest precedence.
+// UpdateSecondary stores its PINs in filename.
+func (ps *Pinstore) AddSecondary(filename string) error {
+	src, err := ps.loadSource(SOURCE_SECONDARY, filename, false)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.sources = append(ps.sources, src)
+	ps.merge()
+	return nil
+}
+
+// UpdateSecondary is like Update, but for the secondary source.
+func (ps *Pinstore) UpdateSecondary(url string) error {
+	var secondary *source
+	ps.mu.Lock()
+	for _, src := range ps.sources {
+		if src.name == SOURCE_SECONDARY {
+			secondary = src
+		}
+	}
+	ps.mu.Unlock()
+	if secondary == nil {
+		return fmt.Errorf("no secondary source, call AddSecondary first")
+	}
+	return ps.update(secondary, url)
+}
+
+// Status returns a human readable description of the sources and which
+// source each effective entry is from. PINs are not included.
+func (ps *Pinstore) Status() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	snapshot := ps.Snapshot()
+	lines := []string{fmt.Sprintf("generation %d, effective since %s",
+		snapshot.Generation, snapshot.Time.Format(time.RFC3339))}
+	for _, src := range ps.sources {
+		filename := src.filename
+		if filename == "" {
+			filename = "(in memory)"
+		}
+		line := fmt.Sprintf("source %s: %s, %d entries", src.name, filename, len(src.current.entries))
+		if src.static {
+			line += ", static"
+		} else if src.lastSync.IsZero() {
+			line += ", not synced yet"
+		} else if src.lastErr != nil {
+			line += fmt.Sprintf(", last sync %s failed: %s", src.lastSync.Format(time.RFC3339), src.lastErr)
+		} else {
+			line += fmt.Sprintf(", last sync %s", src.lastSync.Format(time.RFC3339))
+		}
+		if src.quarantine != nil {
+			line += ", update held: " + strings.Join(src.quarantine.reasons, ", ")
+		}
+		lines = append(lines, line)
+	}
+
+	var entries []string
+	for _, entry := range snapshot.Entries() {
+		entries = append(entries, fmt.Sprintf("entry %s (%s) from %s", entry.Handle, entry.role(), entry.Source))
+	}
+	sort.Strings(entries)
+
+	return strings.Join(append(lines, entries...), "\n") + "\n"
+}
@@ -0,0 +1,103 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for merging several sources.
+package pinstore
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSources(t *testing.T) {
+	filename := tempPins(t, map[string]string{"emergency.json": `[
+	{"handle": "keyholder", "pin": "111111", "role": "keyholder"},
+	{"handle": "emergency", "pin": "333333"}
+	]`})
+	dir := path.Dir(filename)
+	emergency := path.Join(dir, "emergency.json")
+
+	primaryBody := `[{"handle": "member", "pin": "222222"}, {"handle": "primary", "pin": "333333"}]`
+	secondaryBody := `[{"handle": "secondary", "pin": "222222"}, {"handle": "guest", "pin": "444444", "role": "guest"}]`
+	serve := func(body *string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, *body)
+		}))
+	}
+	primary := serve(&primaryBody)
+	defer primary.Close()
+	secondary := serve(&secondaryBody)
+	defer secondary.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadEmergency(emergency); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSecondary(path.Join(dir, "pins-secondary.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(primary.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateSecondary(secondary.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	for pin, expected := range map[string]string{
+		"111111": "keyholder from emergency",
+		"222222": "member from primary",
+		"333333": "emergency from emergency",
+		"444444": "guest from secondary",
+	} {
+		entry, ok := store.Lookup(pin)
+		if !ok {
+			t.Errorf("PIN %s not found", pin)
+			continue
+		}
+		if got := entry.Handle + " from " + entry.Source; got != expected {
+			t.Errorf("PIN %s: expected %s, got %s", pin, expected, got)
+		}
+	}
+
+	// The primary drops the keyholder: the emergency file still works and
+	// is not touched.
+	primaryBody = `[{"handle": "member", "pin": "222222"}]`
+	if err := store.Update(primary.URL); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := store.Lookup("111111"); !ok || entry.Handle != "keyholder" {
+		t.Error("Emergency PIN lost after sync")
+	}
+	if entry, ok := store.Lookup("333333"); !ok || entry.Source != SOURCE_EMERGENCY {
+		t.Error("Emergency PIN lost after sync")
+	}
+	if contents, _ := ioutil.ReadFile(emergency); !strings.Contains(string(contents), "keyholder") {
+		t.Error("Emergency file was modified")
+	}
+
+	status := store.Status()
+	for _, expected := range []string{
+		"source emergency: " + emergency + ", 2 entries, static\n",
+		"source primary: ",
+		"entry keyholder (keyholder) from emergency\n",
+		"entry guest (guest) from secondary\n",
+	} {
+		if !strings.Contains(status, expected) {
+			t.Errorf("Status does not contain %q:\n%s", expected, status)
+		}
+	}
+	if strings.Contains(status, "111111") {
+		t.Error("Status contains a PIN")
+	}
+
+	if err := store.LoadEmergency(path.Join(dir, "nonexistent.json")); err == nil {
+		t.Error("LoadEmergency did not fail for a missing file")
+	}
+}
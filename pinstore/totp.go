@@ -0,0 +1,142 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Time-based one-time passwords (RFC 6238) as an alternative to static PINs.
+// Members who enrolled have an entry with their member id and a base32
+// encoded TOTP secret (like the ones authenticator apps use):
+//
+//	{"handle": "secure", "id": "42", "totp": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}
+//
+// On the keypad, they enter id*code#. Codes of the previous and next
+// TOTPDrift time steps are accepted as well, to cope with clock drift. Every
+// code can only be used once: the last used time step per member is stored in
+// <filename>.totp.
+package pinstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_STEP   = 30 * time.Second
+	TOTP_DIGITS = 6
+)
+
+var ErrReplayed = errors.New("TOTP code already used")
+
+// Decodes a base32 secret, ignoring case, spaces and padding.
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// Returns the HOTP value (RFC 4226) of secret for counter.
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_STEP/time.Second)
+}
+
+// TOTPCode returns the code for secret at t.
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(totpStep(t)))
+}
+
+func (ps *Pinstore) loadTOTPSteps() {
+	ps.totpSteps = make(map[string]int64)
+	if ps.filename == "" {
+		return
+	}
+	contents, err := ioutil.ReadFile(ps.filename + ".totp")
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(contents, &ps.totpSteps); err != nil {
+		fmt.Printf("pinstore: ignoring %s.totp: %s\n", ps.filename, err)
+		ps.totpSteps = make(map[string]int64)
+	}
+}
+
+// UseTOTP checks whether the member with the given id may use code at t. A
+// wrong code results in ErrUnknownPin, just like a wrong static PIN. The
+// code cannot be used again.
+func (ps *Pinstore) UseTOTP(id string, code string, t time.Time) (*Entry, error) {
+	return ps.useTOTP(id, code, t, true)
+}
+
+// CheckTOTP is like UseTOTP, but the code can still be used afterwards.
+func (ps *Pinstore) CheckTOTP(id string, code string, t time.Time) (*Entry, error) {
+	return ps.useTOTP(id, code, t, false)
+}
+
+func (ps *Pinstore) useTOTP(id string, code string, t time.Time, record bool) (*Entry, error) {
+	entry, ok := ps.Snapshot().LookupMember(id)
+	if !ok || len(code) != TOTP_DIGITS {
+		return nil, ErrUnknownPin
+	}
+	secret, err := decodeSecret(entry.TOTP)
+	if err != nil {
+		return nil, ErrUnknownPin
+	}
+
+	now := totpStep(t)
+	matched := false
+	var step int64
+	for drift := -int64(ps.TOTPDrift); drift <= int64(ps.TOTPDrift); drift++ {
+		if hmac.Equal([]byte(hotp(secret, uint64(now+drift))), []byte(code)) {
+			matched = true
+			step = now + drift
+			break
+		}
+	}
+	if !matched {
+		return nil, ErrUnknownPin
+	}
+
+	if entry.Expired(t) {
+		return entry, ErrExpired
+	}
+	if !entry.ValidAt(t) {
+		return entry, ErrNotValidNow
+	}
+
+	ps.usageMu.Lock()
+	defer ps.usageMu.Unlock()
+	if step <= ps.totpSteps[id] {
+		return entry, ErrReplayed
+	}
+	if !record {
+		return entry, nil
+	}
+	ps.totpSteps[id] = step
+	contents, err := json.Marshal(ps.totpSteps)
+	if err == nil && ps.filename != "" {
+		err = writeAtomic(ps.filename+".totp", contents)
+	}
+	if err != nil {
+		fmt.Printf("pinstore: could not save TOTP steps: %s\n", err)
+	}
+	return entry, nil
+}
@@ -0,0 +1,87 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for TOTP verification.
+package pinstore
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B (truncated to 6 digits).
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, test := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if code := TOTPCode(secret, time.Unix(test.unix, 0)); code != test.code {
+			t.Errorf("Code at %d: expected %s, got %s", test.unix, test.code, code)
+		}
+	}
+}
+
+func TestUseTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := base32.StdEncoding.EncodeToString(secret)
+	filename := tempPins(t, map[string]string{"pins.json": `[
+	{"handle": "secure", "id": "42", "totp": "` + encoded + `"},
+	{"handle": "meh", "pin": "992211"}
+	]`})
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111109, 0)
+
+	if _, err := store.UseTOTP("42", "000000", now); err != ErrUnknownPin {
+		t.Errorf("Expected ErrUnknownPin for a wrong code, got %v", err)
+	}
+	if _, err := store.UseTOTP("43", TOTPCode(secret, now), now); err != ErrUnknownPin {
+		t.Errorf("Expected ErrUnknownPin for a wrong id, got %v", err)
+	}
+	// Outside of the drift window.
+	if _, err := store.UseTOTP("42", TOTPCode(secret, now.Add(-2*TOTP_STEP)), now); err != ErrUnknownPin {
+		t.Errorf("Expected ErrUnknownPin for an old code, got %v", err)
+	}
+
+	// Checking a code does not use it.
+	if _, err := store.CheckTOTP("42", TOTPCode(secret, now.Add(-TOTP_STEP)), now); err != nil {
+		t.Fatalf("CheckTOTP failed: %v", err)
+	}
+
+	// The previous code is still accepted…
+	if entry, err := store.UseTOTP("42", TOTPCode(secret, now.Add(-TOTP_STEP)), now); err != nil || entry.Handle != "secure" {
+		t.Fatalf("Previous code not accepted: %v", err)
+	}
+	// …but only once.
+	if _, err := store.UseTOTP("42", TOTPCode(secret, now.Add(-TOTP_STEP)), now); err != ErrReplayed {
+		t.Errorf("Expected ErrReplayed, got %v", err)
+	}
+	if _, err := store.UseTOTP("42", TOTPCode(secret, now), now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay protection survives a restart.
+	store, err = Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UseTOTP("42", TOTPCode(secret, now), now); err != ErrReplayed {
+		t.Errorf("Expected ErrReplayed after Load, got %v", err)
+	}
+
+	// Static PINs keep working.
+	if _, err := store.Use("992211", now); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,273 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Limited-use PINs, e.g. a single-use PIN for a delivery person. Entries with
+// max_uses are counted; the counters are stored in <filename>.uses (so that a
+// restart does not reset them) and reported to the BenutzerDB (see
+// ReportUsage). Unlimited PINs are not counted to save writes to the SD card.
+//
+// The counters belong to an entry (its handle and PIN, see usageKey), so
+// that the duress PIN counts towards the same max_uses and a PIN which is
+// given to someone else later starts with a new counter. Counters of entries
+// which are gone are dropped once their uses were reported (or right away,
+// without KeepUnreported), but only when the source of the entry was synced:
+// an unreachable or unverified source must not reset its counters.
+//
+// If the counters cannot be read (e.g. with the wrong key), Load fails:
+// otherwise, all limited-use PINs would be usable again.
+package pinstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrUnknownPin  = errors.New("unknown PIN")
+	ErrNotValidNow = errors.New("PIN not valid at this time")
+	ErrExpired     = errors.New("PIN expired")
+	ErrUsedUp      = errors.New("PIN used up")
+)
+
+type usage struct {
+	Handle string `json:"handle"`
+	Pin    string `json:"pin"`
+	// The source of the entry, see pruneUsage.
+	Source string `json:"source,omitempty"`
+	Uses   int    `json:"uses"`
+	// How many of the uses the BenutzerDB knows about.
+	Reported int `json:"reported"`
+}
+
+// The body of the POST request to the usage URL is a list of these. Uses is
+// the total number of uses, so a report can safely be sent more than once.
+type UsageReport struct {
+	Handle string `json:"handle"`
+	Pin    string `json:"pin"`
+	Uses   int    `json:"uses"`
+}
+
+// Returns the key of the counter of entry in usage.
+func usageKey(entry *Entry) string {
+	return handleOf(entry) + ":" + entry.Pin
+}
+
+func (ps *Pinstore) loadUsage() error {
+	ps.usage = make(map[string]*usage)
+	if ps.filename == "" {
+		return nil
+	}
+	// The counters are stored by PIN, so they are encrypted like the PINs.
+	filename := ps.filename + ".uses"
+	contents, encrypted, err := readCache(ps.key, filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, &ps.usage); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	if ps.key != nil && !encrypted {
+		if err := writeCache(ps.key, filename, contents); err != nil {
+			return err
+		}
+		fmt.Printf("pinstore: encrypted %s\n", filename)
+	}
+	// Older versions stored the counters by PIN only. These get the key of
+	// their entry when it is used, see counter.
+	for key, u := range ps.usage {
+		if u.Handle == "" && u.Pin == "" {
+			u.Pin = key
+		}
+	}
+	return nil
+}
+
+// Must be called with usageMu held.
+func (ps *Pinstore) saveUsage() error {
+	if ps.filename == "" {
+		return nil
+	}
+	contents, err := json.Marshal(ps.usage)
+	if err != nil {
+		return err
+	}
+	return writeCache(ps.key, ps.filename+".uses", contents)
+}
+
+// Use looks up pin and checks whether it may be used at t. For limited-use
+// PINs, the use is counted (for the entry, see usageKey). If pin is the
+// duress PIN of the entry, entry.DuressPin == pin.
+func (ps *Pinstore) Use(pin string, t time.Time) (*Entry, error) {
+	return ps.use(pin, t, true)
+}
+
+// Check is like Use, but the use is not counted. Permissions can be checked
+// before calling Use, so that a rejected action does not use up the PIN.
+func (ps *Pinstore) Check(pin string, t time.Time) (*Entry, error) {
+	return ps.use(pin, t, false)
+}
+
+func (ps *Pinstore) use(pin string, t time.Time, count bool) (*Entry, error) {
+	snapshot := ps.Snapshot()
+	entry, ok := snapshot.pins[pin]
+	if !ok {
+		entry, ok = snapshot.duress[pin]
+	}
+	if !ok {
+		return nil, ErrUnknownPin
+	}
+	if entry.Expired(t) {
+		return entry, ErrExpired
+	}
+	if !entry.ValidAt(t) {
+		return entry, ErrNotValidNow
+	}
+	if entry.MaxUses == 0 {
+		return entry, nil
+	}
+
+	ps.usageMu.Lock()
+	defer ps.usageMu.Unlock()
+	u := ps.counter(entry)
+	if u != nil && u.Uses >= entry.MaxUses {
+		return entry, ErrUsedUp
+	}
+	if !count {
+		return entry, nil
+	}
+	if u == nil {
+		u = &usage{Handle: handleOf(entry), Pin: entry.Pin}
+		ps.usage[usageKey(entry)] = u
+	}
+	u.Source = entry.Source
+	u.Uses++
+	if err := ps.saveUsage(); err != nil {
+		// Better to open the door once too often than to lock out the
+		// delivery person because of a full SD card.
+		fmt.Printf("pinstore: could not save usage: %s\n", err)
+	}
+	return entry, nil
+}
+
+// Uses returns how often the entry of the limited-use PIN was used.
+func (ps *Pinstore) Uses(pin string) int {
+	snapshot := ps.Snapshot()
+	entry, ok := snapshot.pins[pin]
+	if !ok {
+		entry, ok = snapshot.duress[pin]
+	}
+	if !ok {
+		return 0
+	}
+	ps.usageMu.Lock()
+	defer ps.usageMu.Unlock()
+	if u := ps.counter(entry); u != nil {
+		return u.Uses
+	}
+	return 0
+}
+
+// Returns the counter of entry, or nil if it was not used yet. A counter of
+// an older version (stored by PIN, see loadUsage) becomes the counter of
+// entry. Must be called with usageMu held.
+func (ps *Pinstore) counter(entry *Entry) *usage {
+	key := usageKey(entry)
+	if u, ok := ps.usage[key]; ok {
+		return u
+	}
+	u, ok := ps.usage[entry.Pin]
+	if !ok || u.Handle != "" {
+		return nil
+	}
+	delete(ps.usage, entry.Pin)
+	u.Handle = handleOf(entry)
+	u.Source = entry.Source
+	ps.usage[key] = u
+	if err := ps.saveUsage(); err != nil {
+		fmt.Printf("pinstore: could not save usage: %s\n", err)
+	}
+	return u
+}
+
+// Drops the counters of entries from src which are no longer effective,
+// unless their uses were not reported yet and KeepUnreported is set. Called
+// after src was synced, so that counters are never dropped because a source
+// is not loaded (yet) or could not be verified. Counters of older versions
+// without a source belong to the primary source. Must be called with usageMu
+// held.
+func (ps *Pinstore) pruneUsage(src *source, snapshot *Snapshot) {
+	changed := false
+	current := make(map[string]bool, len(snapshot.pins))
+	for _, entry := range snapshot.pins {
+		current[usageKey(entry)] = true
+		current[entry.Pin] = true
+	}
+	for key, u := range ps.usage {
+		owner := u.Source
+		if owner == "" {
+			owner = SOURCE_PRIMARY
+		}
+		if owner != src.name || current[key] {
+			continue
+		}
+		if u.Reported == u.Uses || !ps.KeepUnreported {
+			delete(ps.usage, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := ps.saveUsage(); err != nil {
+			fmt.Printf("pinstore: could not save usage: %s\n", err)
+		}
+	}
+}
+
+// ReportUsage POSTs the uses which were not reported yet to url as a JSON
+// encoded list of UsageReports. Unsuccessful reports are retried on the next
+// call.
+func (ps *Pinstore) ReportUsage(url string) error {
+	ps.usageMu.Lock()
+	var reports []UsageReport
+	var keys []string
+	for key, u := range ps.usage {
+		if u.Uses == u.Reported {
+			continue
+		}
+		reports = append(reports, UsageReport{Handle: u.Handle, Pin: u.Pin, Uses: u.Uses})
+		keys = append(keys, key)
+	}
+	ps.usageMu.Unlock()
+
+	if len(reports) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+	resp, err := ps.client().Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not report usage: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("could not report usage: unexpected status %s", resp.Status)
+	}
+
+	ps.usageMu.Lock()
+	defer ps.usageMu.Unlock()
+	for idx, report := range reports {
+		if u, ok := ps.usage[keys[idx]]; ok && u.Reported < report.Uses {
+			u.Reported = report.Uses
+		}
+	}
+	fmt.Printf("pinstore: reported usage of %d PINs\n", len(reports))
+	return ps.saveUsage()
+}
@@ -0,0 +1,215 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for limited-use PINs.
+package pinstore
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLimitedUse(t *testing.T) {
+	filename := tempPins(t, map[string]string{"pins.json": `[
+	{"handle": "delivery", "pin": "123456", "max_uses": 1},
+	{"handle": "secure", "pin": "590023"}
+	]`})
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := store.Use("000000", now); err != ErrUnknownPin {
+		t.Errorf("Expected ErrUnknownPin, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if entry, err := store.Check("123456", now); err != nil || entry.Handle != "delivery" {
+			t.Fatalf("Check failed: %v", err)
+		}
+	}
+	if entry, err := store.Use("123456", now); err != nil || entry.Handle != "delivery" {
+		t.Fatalf("First use failed: %v", err)
+	}
+	if _, err := store.Check("123456", now); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp from Check, got %v", err)
+	}
+	if _, err := store.Use("123456", now); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Use("590023", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The counter survives a restart.
+	store, err = Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", now); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp after Load, got %v", err)
+	}
+
+	var received [][]UsageReport
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reports []UsageReport
+		if err := json.NewDecoder(r.Body).Decode(&reports); err != nil {
+			t.Error(err)
+		}
+		received = append(received, reports)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	if err := store.ReportUsage(server.URL); err == nil {
+		t.Fatal("ReportUsage did not fail for status 503")
+	}
+	status = http.StatusOK
+	if err := store.ReportUsage(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing left to report.
+	if err := store.ReportUsage(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 reports, got %d", len(received))
+	}
+	expected := UsageReport{Handle: "delivery", Pin: "123456", Uses: 1}
+	if len(received[1]) != 1 || received[1][0] != expected {
+		t.Errorf("Expected report %v, got %v", expected, received[1])
+	}
+}
+
+func TestUsagePerEntry(t *testing.T) {
+	filename := tempPins(t, nil)
+
+	list := `[{"handle": "delivery", "pin": "123456", "max_uses": 1}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			return
+		}
+		io.WriteString(w, list)
+	}))
+	defer server.Close()
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := store.Use("123456", now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same PIN for someone else starts with a new counter, the counter
+	// of the removed entry is dropped.
+	list = `[{"handle": "plumber", "pin": "123456", "max_uses": 1}]`
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", now); err != nil {
+		t.Errorf("Use of the reassigned PIN failed: %v", err)
+	}
+	if len(store.usage) != 1 {
+		t.Errorf("Expected 1 counter, got %d", len(store.usage))
+	}
+
+	// With KeepUnreported, the counter is kept until it was reported.
+	store.KeepUnreported = true
+	list = `[]`
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.usage) != 1 {
+		t.Fatalf("Unreported counter dropped")
+	}
+	if err := store.ReportUsage(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	list = `[{"handle": "secure", "pin": "590023"}]`
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.usage) != 0 {
+		t.Errorf("Reported counter of a removed PIN kept: %v", store.usage)
+	}
+}
+
+func TestLegacyUsage(t *testing.T) {
+	filename := tempPins(t, map[string]string{
+		"pins.json": `[{"handle": "delivery", "pin": "123456", "max_uses": 1}]`,
+		// Stored by PIN, like older versions did.
+		"pins.json.uses": `{"123456": {"uses": 1, "reported": 0}}`,
+	})
+
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Use("123456", time.Now()); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp, got %v", err)
+	}
+	if _, ok := store.usage["delivery:123456"]; !ok {
+		t.Errorf("Counter not migrated: %v", store.usage)
+	}
+}
+
+// The counters of other sources survive a restart and syncs of the primary
+// source, even while the PINs cannot be verified.
+func TestUsageOfSecondary(t *testing.T) {
+	filename := tempPins(t, map[string]string{
+		"pins.json":           `[{"handle": "secure", "pin": "590023"}]`,
+		"pins-secondary.json": `[{"handle": "delivery", "pin": "123456", "max_uses": 1}]`,
+	})
+	secondary := path.Join(path.Dir(filename), "pins-secondary.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"handle": "meh", "pin": "992211"}]`)
+	}))
+	defer server.Close()
+
+	load := func(opts Options) *Pinstore {
+		store, err := LoadWithOptions(filename, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddSecondary(secondary); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	store := load(Options{})
+	if _, err := store.Use("123456", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing can be verified with a public key, so there are no PINs…
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store := load(Options{PublicKey: publicKey}); store.Snapshot().Len() != 0 {
+		t.Fatal("Unsigned PINs were loaded")
+	}
+
+	// …but the counter is still there.
+	store = load(Options{})
+	if _, err := store.Use("123456", time.Now()); err != ErrUsedUp {
+		t.Errorf("Expected ErrUsedUp after restart, got %v", err)
+	}
+}
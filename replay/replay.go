@@ -0,0 +1,71 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Plays back a capture file (see pinpad-controller -capture) through the
+// TestFrontend and prints what the frontend package makes of it. This way,
+// keypad issues from the field can be reproduced on a developer machine.
+//
+//	replay -speed=1 /tmp/pinpad.capture
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pinpad-controller/frontend"
+	"pinpad-controller/testfrontend"
+	"pinpad-controller/uart"
+	"time"
+)
+
+var speed = flag.Float64(
+	"speed",
+	0,
+	"Replay speed relative to the recording, 0 replays as fast as possible")
+
+var linger = flag.Duration(
+	"linger",
+	1*time.Second,
+	"How long to wait for keypresses after the capture was played back")
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <capture>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := uart.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Could not read capture: %s", err)
+	}
+
+	testfe := testfrontend.NewReplayFrontend()
+	done := make(chan bool)
+	go func() {
+		testfe.Replay(entries, *speed)
+		done <- true
+	}()
+	fe := frontend.OpenFrontendish(testfe)
+
+	var timeout <-chan time.Time
+	for {
+		select {
+		case keypress := <-fe.Keypresses:
+			fmt.Printf("keypress: %s\n", keypress.Key)
+		case <-done:
+			timeout = time.After(*linger)
+		case <-timeout:
+			stats := fe.Stats()
+			fmt.Printf("%d packets, %d framing errors, %d checksum errors\n",
+				stats.Packets, stats.FramingErrors, stats.ChecksumErrors)
+			return
+		}
+	}
+}
@@ -7,53 +7,123 @@ package testfrontend
 import (
 	"fmt"
 	"os"
+	"pinpad-controller/uart"
 	"strings"
+	"sync"
+	"time"
 )
 
 type TestFrontend struct {
 	os.File
 
-	buffer     []byte
-	currentIdx int
-	newBuffer  chan bool
+	// Protects buffer. newBuffer is signaled whenever bytes are added.
+	mu        sync.Mutex
+	buffer    []byte
+	newBuffer *sync.Cond
+	closed    bool
+
+	// The answer to HELLO. The empty string emulates old firmware, which
+	// does not answer.
+	Hello string
+	// If true, we neither answer PING nor HELLO (see NewReplayFrontend).
+	silent bool
+
+	// All packets which were written to the TestFrontend.
+	writtenMu sync.Mutex
+	written   []string
 }
 
 // Initializes a new TestFrontend instance
 func NewTestFrontend() (tf *TestFrontend) {
 	tf = new(TestFrontend)
-	tf.newBuffer = make(chan bool)
-	tf.currentIdx = 999
+	tf.newBuffer = sync.NewCond(&tf.mu)
+	tf.Hello = "^HI 0100$"
 	return tf
 }
 
-// Puts the given string in the buffer. This buffer will be read out by Read().
+// Appends the given string to the buffer. This buffer will be read out by
+// Read(). FillBuffer does not block, so it can be called from Write().
 func (tf *TestFrontend) FillBuffer(content string) {
-	tf.buffer = []byte(content)
-	tf.newBuffer <- true
+	tf.mu.Lock()
+	tf.buffer = append(tf.buffer, content...)
+	tf.mu.Unlock()
+	tf.newBuffer.Signal()
 }
 
 // Returns one character from the buffer, or blocks in case the buffer is
 // empty.
 func (tf *TestFrontend) Read(p []byte) (n int, err error) {
-	//fmt.Printf("currentIdx = %d, len = %d\n", tf.currentIdx, len(tf.buffer))
-	if tf.currentIdx >= len(tf.buffer) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	for len(tf.buffer) == 0 {
+		if tf.closed {
+			return 0, os.ErrClosed
+		}
 		// Block until we get a new buffer
-		<-tf.newBuffer
-		tf.currentIdx = 0
-		//fmt.Printf("after block: currentIdx = %d, len = %d\n", tf.currentIdx, len(tf.buffer))
+		tf.newBuffer.Wait()
 	}
-	p[0] = tf.buffer[tf.currentIdx]
-	//fmt.Printf("returning byte %c\n", p[0])
-	tf.currentIdx += 1
+	p[0] = tf.buffer[0]
+	tf.buffer = tf.buffer[1:]
 	return 1, nil
 }
 
+// Unblocks pending reads, which then return os.ErrClosed once the buffer is
+// empty.
+func (tf *TestFrontend) Close() error {
+	tf.mu.Lock()
+	tf.closed = true
+	tf.mu.Unlock()
+	tf.newBuffer.Broadcast()
+	return nil
+}
+
+// Initializes a new TestFrontend which does not answer by itself. Use Replay()
+// to play back the inbound data of a capture.
+func NewReplayFrontend() (tf *TestFrontend) {
+	tf = NewTestFrontend()
+	tf.silent = true
+	return tf
+}
+
+// Puts the inbound data of the capture in the buffer. If speed is > 0, the
+// time between the entries is preserved (divided by speed), otherwise the
+// data is put into the buffer at once.
+func (tf *TestFrontend) Replay(entries []uart.CaptureEntry, speed float64) {
+	var last time.Time
+	for _, entry := range entries {
+		if entry.Direction != uart.INBOUND {
+			continue
+		}
+		if speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(entry.Time.Sub(last)) / speed))
+		}
+		last = entry.Time
+		tf.FillBuffer(string(entry.Data))
+	}
+}
+
+// Returns all packets which were written to the TestFrontend so far.
+func (tf *TestFrontend) Written() []string {
+	tf.writtenMu.Lock()
+	defer tf.writtenMu.Unlock()
+	return append([]string(nil), tf.written...)
+}
+
 func (tf *TestFrontend) Write(b []byte) (n int, err error) {
 	packet := string(b)
+	tf.writtenMu.Lock()
+	tf.written = append(tf.written, packet)
+	tf.writtenMu.Unlock()
+	if tf.silent {
+		return 0, nil
+	}
 	//fmt.Printf("Write, len = %d, str = %s\n", len(b), string(b))
 	if strings.HasPrefix(packet, "^PING ") {
 		response := fmt.Sprintf("^PONG %c%c$", b[6], b[7])
 		tf.FillBuffer(response)
 	}
+	if strings.HasPrefix(packet, "^HELLO") && tf.Hello != "" {
+		tf.FillBuffer(tf.Hello)
+	}
 	return 0, nil
 }
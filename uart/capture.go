@@ -0,0 +1,139 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Recording of the serial traffic. A Recorder wraps a TTYish and writes all
+// bytes which are read or written to a capture file, one line per chunk:
+//
+//	2013-01-02T15:04:05.123456789+01:00 < "^PAD 1  $"
+//	2013-01-02T15:04:05.200000000+01:00 > "^LCD PIN: *     ...$"
+//
+// '<' means the bytes were read from the frontend, '>' means they were
+// written to the frontend. The data is quoted like a Go string.
+//
+// Digits of keypresses (^PAD 1) are recorded as x, so that captures do not
+// contain PINs. A replayed capture still has the timing and number of
+// keypresses.
+package uart
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Direction byte
+
+const (
+	INBOUND  = Direction('<')
+	OUTBOUND = Direction('>')
+)
+
+type CaptureEntry struct {
+	Time      time.Time
+	Direction Direction
+	Data      []byte
+}
+
+type Recorder struct {
+	tty TTYish
+
+	mu      sync.Mutex
+	capture io.Writer
+	// The last bytes read, to recognize keypresses which are split across
+	// reads.
+	tail []byte
+}
+
+const padPrefix = "^PAD "
+
+// NewRecorder returns a TTYish which passes all reads and writes to tty and
+// records them to capture.
+func NewRecorder(tty TTYish, capture io.Writer) *Recorder {
+	return &Recorder{tty: tty, capture: capture}
+}
+
+func (r *Recorder) record(direction Direction, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := fmt.Fprintf(r.capture, "%s %c %s\n",
+		time.Now().Format(time.RFC3339Nano), direction, strconv.Quote(string(data)))
+	if err != nil {
+		fmt.Printf("uart: could not write capture: %s\n", err)
+	}
+}
+
+// Returns a copy of data with the digits of keypresses replaced by x.
+func (r *Recorder) mask(data []byte) []byte {
+	masked := make([]byte, len(data))
+	for idx, b := range data {
+		if b >= '0' && b <= '9' && string(r.tail) == padPrefix {
+			b = 'x'
+		}
+		masked[idx] = b
+		r.tail = append(r.tail, data[idx])
+		if len(r.tail) > len(padPrefix) {
+			r.tail = r.tail[1:]
+		}
+	}
+	return masked
+}
+
+func (r *Recorder) Read(p []byte) (n int, err error) {
+	n, err = r.tty.Read(p)
+	if n > 0 {
+		r.mu.Lock()
+		masked := r.mask(p[:n])
+		r.mu.Unlock()
+		r.record(INBOUND, masked)
+	}
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (n int, err error) {
+	r.record(OUTBOUND, p)
+	return r.tty.Write(p)
+}
+
+// Close closes the underlying TTYish (if it implements io.Closer). The
+// capture is not closed.
+func (r *Recorder) Close() error {
+	if closer, ok := r.tty.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ReadCapture parses a capture file written by a Recorder.
+func ReadCapture(capture io.Reader) ([]CaptureEntry, error) {
+	var entries []CaptureEntry
+	scanner := bufio.NewScanner(capture)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || len(fields[1]) != 1 {
+			return nil, fmt.Errorf("line %d: expected <time> <direction> <data>", lineno)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		direction := Direction(fields[1][0])
+		if direction != INBOUND && direction != OUTBOUND {
+			return nil, fmt.Errorf("line %d: invalid direction %q", lineno, fields[1])
+		}
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid data: %s", lineno, err)
+		}
+		entries = append(entries, CaptureEntry{t, direction, []byte(data)})
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,67 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Pseudo terminals and raw mode, used by the frontend emulator.
+package uart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenPTY creates a new pseudo terminal and returns its master side. The slave
+// side can be opened with OpenTTY(slavePath, …), just like a real serial
+// interface.
+func OpenPTY() (master *os.File, slavePath string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var ptn uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&ptn)); err != nil {
+		master.Close()
+		return nil, "", errors.New("Error in TIOCGPTN: " + err.Error())
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, "", errors.New("Error in TIOCSPTLCK: " + err.Error())
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", ptn), nil
+}
+
+// MakeRaw puts the terminal (for example stdin) into raw mode, so that every
+// keystroke can be read immediately. The returned function restores the
+// previous state.
+func MakeRaw(f *os.File) (restore func() error, err error) {
+	var oldState syscall.Termios
+	if err := ioctl(f.Fd(), TCGETS, unsafe.Pointer(&oldState)); err != nil {
+		return nil, errors.New("Error in TCGETS: " + err.Error())
+	}
+
+	newState := oldState
+	newState.Iflag &^= IGNBRK | BRKINT | PARMRK | ISTRIP | INLCR | IGNCR | ICRNL | IXON
+	newState.Lflag &^= ECHO | ECHONL | ICANON | ISIG | IEXTEN
+	newState.Cc[VMIN] = 1
+	newState.Cc[VTIME] = 0
+	if err := ioctl(f.Fd(), TCSETS, unsafe.Pointer(&newState)); err != nil {
+		return nil, errors.New("Error in TCSETS: " + err.Error())
+	}
+
+	return func() error {
+		return ioctl(f.Fd(), TCSETS, unsafe.Pointer(&oldState))
+	}, nil
+}
@@ -0,0 +1,112 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// termios constants and ioctl numbers. The syscall package only has them for
+// some architectures, so we define them here. The values are those of
+// asm-generic/termbits.h and asm-generic/ioctls.h, which arm, arm64, 386 and
+// amd64 share (mips, ppc and sparc do not, hence the build constraint).
+
+//go:build linux && (arm || arm64 || 386 || amd64)
+
+package uart
+
+// ioctl requests
+const (
+	TCGETS   = 0x5401
+	TCSETS   = 0x5402
+	TCSETSW  = 0x5403
+	TCSETSF  = 0x5404
+	TIOCMGET = 0x5415
+	TIOCMBIS = 0x5416
+	TIOCMBIC = 0x5417
+	TIOCMSET = 0x5418
+)
+
+// modem lines
+const (
+	TIOCM_RTS = 0x004
+)
+
+// c_iflag
+const (
+	IGNBRK = 0000001
+	BRKINT = 0000002
+	IGNPAR = 0000004
+	PARMRK = 0000010
+	INPCK  = 0000020
+	ISTRIP = 0000040
+	INLCR  = 0000100
+	IGNCR  = 0000200
+	ICRNL  = 0000400
+	IXON   = 0002000
+	IXOFF  = 0010000
+)
+
+// c_oflag
+const (
+	OPOST = 0000001
+)
+
+// c_cflag
+const (
+	CBAUD   = 0010017
+	CSIZE   = 0000060
+	CS5     = 0000000
+	CS6     = 0000020
+	CS7     = 0000040
+	CS8     = 0000060
+	CSTOPB  = 0000100
+	CREAD   = 0000200
+	PARENB  = 0000400
+	PARODD  = 0001000
+	CLOCAL  = 0004000
+	CRTSCTS = 020000000000
+)
+
+// c_lflag
+const (
+	ISIG   = 0000001
+	ICANON = 0000002
+	ECHO   = 0000010
+	ECHONL = 0000100
+	IEXTEN = 0100000
+)
+
+// c_cc indices
+const (
+	VTIME = 5
+	VMIN  = 6
+)
+
+// speed constants (c_cflag & CBAUD)
+var speeds = map[int]uint32{
+	50:      0000001,
+	75:      0000002,
+	110:     0000003,
+	134:     0000004,
+	150:     0000005,
+	200:     0000006,
+	300:     0000007,
+	600:     0000010,
+	1200:    0000011,
+	1800:    0000012,
+	2400:    0000013,
+	4800:    0000014,
+	9600:    0000015,
+	19200:   0000016,
+	38400:   0000017,
+	57600:   0010001,
+	115200:  0010002,
+	230400:  0010003,
+	460800:  0010004,
+	500000:  0010005,
+	576000:  0010006,
+	921600:  0010007,
+	1000000: 0010010,
+	1152000: 0010011,
+	1500000: 0010012,
+	2000000: 0010013,
+	2500000: 0010014,
+	3000000: 0010015,
+	3500000: 0010016,
+	4000000: 0010017,
+}
@@ -4,18 +4,30 @@
 // Unfortunately, Go has no package to use a tty interface, which we use to
 // communicate with the Pinpad frontend via RS232. Therefore, we need to use
 // the low-level syscall wrappers here.
+//
+// The tty is opened non-blocking, so that the Go runtime polls it. This means
+// that reads and writes support deadlines (SetReadDeadline etc. of os.File)
+// and cancellation (ReadContext, WriteContext), and that Close unblocks
+// pending reads.
 package uart
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 type TTY struct {
 	os.File
+
+	config Config
 }
 
 type TTYish interface {
@@ -23,129 +35,314 @@ type TTYish interface {
 	io.Writer
 }
 
-// termios types
-type cc_t byte
-type speed_t uint
-type tcflag_t uint
+type Parity int
 
-// speed constants
 const (
-	B0 = iota
-	B50
-	B75
-	B110
-	B134
-	B150
-	B200
-	B300
-	B600
-	B1200
-	B1800
-	B2400
-	B4800
-	B9600
-	B19200
-	B38400
-	B57600 = 0010001
-	B115200
+	PARITY_NONE = Parity(0)
+	PARITY_ODD  = Parity(1)
+	PARITY_EVEN = Parity(2)
 )
 
-// termios constants
-const (
-	BRKINT = tcflag_t(0000002)
-	ICRNL  = tcflag_t(0000400)
-	INPCK  = tcflag_t(0000020)
-	ISTRIP = tcflag_t(0000040)
-	IXON   = tcflag_t(0002000)
-	OPOST  = tcflag_t(0000001)
-	CS8    = tcflag_t(0000060)
-	ECHO   = tcflag_t(0000010)
-	ICANON = tcflag_t(0000002)
-	IEXTEN = tcflag_t(0100000)
-	ISIG   = tcflag_t(0000001)
-	CBAUD  = tcflag_t(0010017)
-	CIBAUD = tcflag_t(002003600000)
-	VTIME  = tcflag_t(5)
-	VMIN   = tcflag_t(6)
-)
+type FlowControl int
 
 const (
-	TIOCM_RTS = 0x004
+	FLOW_NONE = FlowControl(0)
+	// RTS/CTS
+	FLOW_HARDWARE = FlowControl(1)
+	// XON/XOFF
+	FLOW_SOFTWARE = FlowControl(2)
 )
 
-const NCCS = 32
+type Config struct {
+	Baud        int
+	DataBits    int
+	Parity      Parity
+	StopBits    int
+	FlowControl FlowControl
+	// If non-zero, Read returns ErrTimeout when no byte arrived within
+	// ReadTimeout. Otherwise, Read blocks until at least one byte arrived (or
+	// the read deadline passed).
+	ReadTimeout time.Duration
+	// Whether to assert RTS after opening. Some level shifters on the
+	// Raspberry Pi draw their power from it.
+	RTS bool
+}
+
+// 9600 baud, 8N1, no flow control. This is what the frontend speaks.
+var DefaultConfig = Config{Baud: 9600, DataBits: 8, StopBits: 1}
 
-type termios struct {
-	c_iflag, c_oflag, c_cflag, c_lflag tcflag_t
-	c_line                             cc_t
-	c_cc                               [NCCS]cc_t
-	c_ispeed, c_ospeed                 speed_t
+var ErrTimeout = errors.New("uart: read timeout")
+
+func (c Config) String() string {
+	parity := "N"
+	if c.Parity == PARITY_ODD {
+		parity = "O"
+	} else if c.Parity == PARITY_EVEN {
+		parity = "E"
+	}
+	s := fmt.Sprintf("%d,%d%s%d", c.Baud, c.DataBits, parity, c.StopBits)
+	if c.FlowControl == FLOW_HARDWARE {
+		s += ",rtscts"
+	} else if c.FlowControl == FLOW_SOFTWARE {
+		s += ",xonxoff"
+	}
+	if c.RTS {
+		s += ",rts"
+	}
+	if c.ReadTimeout != 0 {
+		s += ",timeout=" + c.ReadTimeout.String()
+	}
+	return s
 }
 
-// ioctl constants
-const (
-	TCGETS   = 0x5401
-	TCSETS   = 0x5402
-	TCSETSW  = 0x5403
-	TCSETSF  = 0x5404
-	TIOCMGET = 0x5415
-	TIOCMSET = 0x5418
-)
+// ParseConfig parses configurations like "9600,8N1" or
+// "115200,7E2,rtscts,rts,timeout=1s", the format of Config.String(). Omitted
+// parts are taken from DefaultConfig.
+func ParseConfig(s string) (Config, error) {
+	config := DefaultConfig
+	for idx, part := range strings.Split(s, ",") {
+		switch {
+		case idx == 0:
+			baud, err := strconv.Atoi(part)
+			if err != nil {
+				return config, fmt.Errorf("invalid baud rate %q", part)
+			}
+			config.Baud = baud
+		case len(part) == 3 && part[0] >= '5' && part[0] <= '8' && (part[2] == '1' || part[2] == '2'):
+			config.DataBits = int(part[0] - '0')
+			config.StopBits = int(part[2] - '0')
+			switch part[1] {
+			case 'N':
+				config.Parity = PARITY_NONE
+			case 'O':
+				config.Parity = PARITY_ODD
+			case 'E':
+				config.Parity = PARITY_EVEN
+			default:
+				return config, fmt.Errorf("invalid parity %q", part[1])
+			}
+		case part == "rtscts":
+			config.FlowControl = FLOW_HARDWARE
+		case part == "xonxoff":
+			config.FlowControl = FLOW_SOFTWARE
+		case part == "rts":
+			config.RTS = true
+		case strings.HasPrefix(part, "timeout="):
+			timeout, err := time.ParseDuration(part[len("timeout="):])
+			if err != nil {
+				return config, err
+			}
+			config.ReadTimeout = timeout
+		default:
+			return config, fmt.Errorf("invalid serial setting %q", part)
+		}
+	}
+	if _, ok := speeds[config.Baud]; !ok {
+		return config, fmt.Errorf("unsupported baud rate %d", config.Baud)
+	}
+	return config, nil
+}
+
+// termios returns the termios settings for the configuration: raw mode (no
+// echo, no line editing, no character translation) plus the line settings.
+func (c Config) termios() (*syscall.Termios, error) {
+	speed, ok := speeds[c.Baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", c.Baud)
+	}
+
+	var t syscall.Termios
+	t.Cflag = CLOCAL | CREAD | speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+
+	switch c.DataBits {
+	case 5:
+		t.Cflag |= CS5
+	case 6:
+		t.Cflag |= CS6
+	case 7:
+		t.Cflag |= CS7
+	case 8:
+		t.Cflag |= CS8
+	default:
+		return nil, fmt.Errorf("unsupported number of data bits: %d", c.DataBits)
+	}
+
+	switch c.Parity {
+	case PARITY_NONE:
+	case PARITY_ODD:
+		t.Cflag |= PARENB | PARODD
+		t.Iflag |= INPCK
+	case PARITY_EVEN:
+		t.Cflag |= PARENB
+		t.Iflag |= INPCK
+	default:
+		return nil, fmt.Errorf("unsupported parity %d", c.Parity)
+	}
+
+	switch c.StopBits {
+	case 1:
+	case 2:
+		t.Cflag |= CSTOPB
+	default:
+		return nil, fmt.Errorf("unsupported number of stop bits: %d", c.StopBits)
+	}
+
+	switch c.FlowControl {
+	case FLOW_NONE:
+	case FLOW_HARDWARE:
+		t.Cflag |= CRTSCTS
+	case FLOW_SOFTWARE:
+		t.Iflag |= IXON | IXOFF
+	default:
+		return nil, fmt.Errorf("unsupported flow control %d", c.FlowControl)
+	}
+
+	// VMIN = 1 means that at least one character needs to be in the input
+	// buffer before the tty becomes readable. ReadTimeout is implemented
+	// using deadlines instead of VTIME, because VTIME has no effect on
+	// non-blocking file descriptors.
+	t.Cc[VMIN] = 1
+	t.Cc[VTIME] = 0
+
+	return &t, nil
+}
 
-var fd uintptr
+func (tty *TTY) ioctl(request uintptr, arg unsafe.Pointer) error {
+	return ioctl(tty.Fd(), request, arg)
+}
 
-func (tty *TTY) setTermios(src *termios) error {
-	fd := tty.Fd()
-	r1, _, _ := syscall.RawSyscall(syscall.SYS_IOCTL,
-		uintptr(fd), uintptr(TCSETSF),
-		uintptr(unsafe.Pointer(src)))
+func (tty *TTY) setTermios(src *syscall.Termios) error {
+	if err := tty.ioctl(TCSETSF, unsafe.Pointer(src)); err != nil {
+		return errors.New("Error in TCSETS: " + err.Error())
+	}
+	return nil
+}
 
-	if r1 != 0 {
-		return errors.New("Error in TCSETS")
+func (tty *TTY) getTermios() (*syscall.Termios, error) {
+	var t syscall.Termios
+	if err := tty.ioctl(TCGETS, unsafe.Pointer(&t)); err != nil {
+		return nil, errors.New("Error in TCGETS: " + err.Error())
 	}
+	return &t, nil
+}
 
+// SetRTS enables/disables RTS (Ready To Send).
+func (tty *TTY) SetRTS(rts bool) error {
+	request := uintptr(TIOCMBIC)
+	if rts {
+		request = TIOCMBIS
+	}
+	bits := int32(TIOCM_RTS)
+	if err := tty.ioctl(request, unsafe.Pointer(&bits)); err != nil {
+		return errors.New("Error in TIOCMBIS/TIOCMBIC: " + err.Error())
+	}
 	return nil
 }
 
-// We don’t need this right now using the usb2serial. Maybe on the Raspberry Pi
-// itself? We’ll see.
-//// Enables/Disables RTS (Ready To Send)
-//func (tty *TTY) SetRTS(rts uint) error {
-//	var mcs uint
-//	fd := tty.Fd()
-//	r1, _, _ := syscall.RawSyscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TIOCMGET), uintptr(unsafe.Pointer(&mcs)))
-//	if r1 != 0 {
-//		return errors.New("Error in TIOCMGET")
-//	}
-//	mcs = mcs | TIOCM_RTS
-//	r1, _, _ = syscall.RawSyscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TIOCMSET), uintptr(unsafe.Pointer(&mcs)))
-//	if r1 != 0 {
-//		return errors.New("Error in TIOCMSET")
-//	}
-//
-//	return nil
-//}
+// Read reads from the tty. With Config.ReadTimeout, ErrTimeout is returned if
+// no byte arrived in time. Otherwise, Read honors the deadline set with
+// SetReadDeadline and returns an error wrapping os.ErrDeadlineExceeded.
+func (tty *TTY) Read(p []byte) (n int, err error) {
+	if tty.config.ReadTimeout == 0 {
+		return tty.File.Read(p)
+	}
+	return tty.ReadContext(context.Background(), p)
+}
+
+// A deadline in the past, used to interrupt pending reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContext runs op (a read or write) with the deadline of ctx and
+// interrupts it when ctx is cancelled. If ctx ends before op finished,
+// ctx.Err() is returned.
+func withContext(ctx context.Context, setDeadline func(time.Time) error, op func() (int, error)) (int, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if err := setDeadline(deadline); err != nil {
+		return 0, err
+	}
+	interrupted := make(chan bool)
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(aLongTimeAgo)
+		close(interrupted)
+	})
+	n, err := op()
+	if !stop() {
+		// Wait until the deadline was set, so that it does not interrupt
+		// the next read or write.
+		<-interrupted
+	}
+	setDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+		// The runtime poller noticed the deadline before the timer of
+		// ctx fired.
+		if hasDeadline {
+			return n, context.DeadlineExceeded
+		}
+	}
+	return n, err
+}
+
+// ReadContext is like Read, but returns ctx.Err() when ctx is cancelled or its
+// deadline passes before any byte arrived. It clears the read deadline.
+func (tty *TTY) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if tty.config.ReadTimeout == 0 {
+		return withContext(ctx, tty.File.SetReadDeadline, func() (int, error) {
+			return tty.File.Read(p)
+		})
+	}
 
-func OpenTTY(path string, speed speed_t) (tty *TTY, err error) {
-	uartFile, e := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	timeoutCtx, cancel := context.WithTimeout(ctx, tty.config.ReadTimeout)
+	defer cancel()
+	n, err = withContext(timeoutCtx, tty.File.SetReadDeadline, func() (int, error) {
+		return tty.File.Read(p)
+	})
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return n, ErrTimeout
+	}
+	return n, err
+}
+
+// WriteContext is like Write, but returns ctx.Err() when ctx is cancelled or
+// its deadline passes before all bytes were written (for example because the
+// other side does not read and flow control is enabled). It clears the write
+// deadline.
+func (tty *TTY) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	return withContext(ctx, tty.File.SetWriteDeadline, func() (int, error) {
+		return tty.File.Write(p)
+	})
+}
+
+func OpenTTY(path string, config Config) (tty *TTY, err error) {
+	newState, e := config.termios()
 	if e != nil {
 		return nil, e
 	}
 
-	uartTTY := &TTY{*uartFile}
+	// O_NONBLOCK makes the Go runtime poll the file descriptor, see the
+	// package comment.
+	uartFile, e := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if e != nil {
+		return nil, e
+	}
 
-	var newState termios
-	newState.c_iflag = 0
-	newState.c_oflag = 0
-	newState.c_lflag = 0
-	newState.c_cflag = syscall.CLOCAL | syscall.CREAD | syscall.CS8 | tcflag_t(speed)
-	// VMIN = 1 means that at least one character needs to be in the input
-	// buffer before read() returns. This makes us able to use blocking reads.
-	newState.c_cc[VMIN] = 1
+	uartTTY := &TTY{File: *uartFile, config: config}
 
-	if e := uartTTY.setTermios(&newState); e != nil {
+	if e := uartTTY.setTermios(newState); e != nil {
+		uartFile.Close()
 		return nil, e
 	}
 
+	if config.RTS {
+		if e := uartTTY.SetRTS(true); e != nil {
+			uartFile.Close()
+			return nil, e
+		}
+	}
+
 	return uartTTY, nil
 }
@@ -0,0 +1,160 @@
+// vim:ts=4:sw=4:noexpandtab
+//
+// Testcases for the uart package. They use a pseudo terminal instead of a
+// real serial interface, so they run on any (Linux) developer machine.
+package uart
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("115200,7E2,rtscts,rts,timeout=500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Baud:        115200,
+		DataBits:    7,
+		Parity:      PARITY_EVEN,
+		StopBits:    2,
+		FlowControl: FLOW_HARDWARE,
+		ReadTimeout: 500 * time.Millisecond,
+		RTS:         true,
+	}
+	if config != want {
+		t.Errorf("Expected %+v, got %+v", want, config)
+	}
+	if config.String() != "115200,7E2,rtscts,rts,timeout=500ms" {
+		t.Errorf("Config does not round-trip: %s", config)
+	}
+
+	if config, err := ParseConfig("9600"); err != nil || config != DefaultConfig {
+		t.Errorf("Expected the default config, got %+v (%v)", config, err)
+	}
+
+	for _, invalid := range []string{"9601", "9600,8X1", "9600,9N1", "9600,foo", "fast"} {
+		if _, err := ParseConfig(invalid); err == nil {
+			t.Errorf("Invalid config %q accepted", invalid)
+		}
+	}
+}
+
+// openTestTTY creates a pty and opens its slave side with the given config.
+func openTestTTY(t *testing.T, config Config) *TTY {
+	master, slavePath, err := OpenPTY()
+	if err != nil {
+		t.Skipf("Cannot create a pty: %s", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	tty, err := OpenTTY(slavePath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+	return tty
+}
+
+func TestTermios(t *testing.T) {
+	config, _ := ParseConfig("57600,7E2,xonxoff")
+	termios, err := config.termios()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cflag&CSIZE != CS7 {
+		t.Errorf("Unexpected character size bits %o", termios.Cflag&CSIZE)
+	}
+	if termios.Cflag&(PARENB|PARODD) != PARENB || termios.Iflag&INPCK == 0 {
+		t.Errorf("Even parity not set up, c_cflag = %o, c_iflag = %o", termios.Cflag, termios.Iflag)
+	}
+	if termios.Iflag&(IXON|IXOFF) != IXON|IXOFF || termios.Cflag&CRTSCTS != 0 {
+		t.Errorf("Software flow control not set up, c_cflag = %o, c_iflag = %o", termios.Cflag, termios.Iflag)
+	}
+}
+
+// The pty driver always uses CS8 without parity, so we can only verify the
+// remaining settings on a pty.
+func TestOpenTTYConfig(t *testing.T) {
+	config, _ := ParseConfig("57600,8O2,rtscts")
+	tty := openTestTTY(t, config)
+
+	termios, err := tty.getTermios()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Cflag&CBAUD != speeds[57600] {
+		t.Errorf("Unexpected speed bits %o", termios.Cflag&CBAUD)
+	}
+	for name, flag := range map[string]uint32{"PARODD": PARODD, "CSTOPB": CSTOPB, "CRTSCTS": CRTSCTS} {
+		if termios.Cflag&flag == 0 {
+			t.Errorf("%s not set in c_cflag %o", name, termios.Cflag)
+		}
+	}
+	if termios.Lflag&(ECHO|ICANON) != 0 {
+		t.Errorf("tty not in raw mode, c_lflag = %o", termios.Lflag)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	config := DefaultConfig
+	config.ReadTimeout = 200 * time.Millisecond
+	tty := openTestTTY(t, config)
+
+	start := time.Now()
+	buf := make([]byte, 1)
+	if _, err := tty.Read(buf); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Read returned after %s already", elapsed)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	tty := openTestTTY(t, DefaultConfig)
+	buf := make([]byte, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := tty.ReadContext(ctx, buf); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := tty.ReadContext(ctx, buf); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	tty.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := tty.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	tty := openTestTTY(t, DefaultConfig)
+	result := make(chan error)
+	go func() {
+		_, err := tty.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	tty.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected os.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked 1s after Close")
+	}
+}